@@ -12,39 +12,98 @@ import (
 	"github.com/devopsfaith/krakend/logging"
 
 	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 )
 
+// Instance health status reported by the autoscaling group
+const asgHealthy = "Healthy"
+
 //Node counter for amazon EC2
 func NewAwsNodeCounter(EC2 *EC2, autoScaling *AutoScaling,
 	iid *ec2metadata.EC2InstanceIdentityDocument, logger logging.Logger) NodeCounter {
-	lastNumber := 3
-	return func() int {
-		autoScalingName, err := EC2.GetAsgName(iid.InstanceID)
-		if err != nil {
-			return lastNumber
+	return NewAwsNodeCounterWithConfig(EC2, autoScaling, nil, iid, NodeCounterConfig{Type: AwsNodeCounter}, logger)
+}
+
+// Node counter for amazon EC2. It counts the InService and Healthy instances of the autoscaling
+// group of the running instance. If cfg.TargetGroup is set, the instances deregistered from that
+// ELB target group (or being deregistered) are not counted either
+func NewAwsNodeCounterWithConfig(EC2 *EC2, autoScaling *AutoScaling, elb *ELBV2,
+	iid *ec2metadata.EC2InstanceIdentityDocument, cfg NodeCounterConfig, logger logging.Logger) NodeCounter {
+	return newAwsNodes(EC2, autoScaling, elb, iid, cfg, logger).Count
+}
+
+// The nodes are identified by their instance id
+func newAwsNodes(EC2 *EC2, autoScaling *AutoScaling, elb *ELBV2,
+	iid *ec2metadata.EC2InstanceIdentityDocument, cfg NodeCounterConfig, logger logging.Logger) *lastKnownNodes {
+	// the autoscaling group and the target group of an instance never change
+	var autoScalingName, targetGroupArn string
+
+	return newLastKnownNodes(AwsNodeCounter, cfg, iid.InstanceID, func() ([]string, error) {
+		if autoScalingName == "" {
+			name, err := EC2.GetAsgName(iid.InstanceID)
+			if err != nil {
+				return nil, err
+			}
+			autoScalingName = name
 		}
 
 		asgNames := []*string{aws.String(autoScalingName)}
 		result, err := autoScaling.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{AutoScalingGroupNames: asgNames})
 		if err != nil {
-			return lastNumber
+			return nil, err
+		}
+		if len(result.AutoScalingGroups) != 1 {
+			return nil, fmt.Errorf("autoscaling group %s not found", autoScalingName)
 		}
 
-		if len(result.AutoScalingGroups) == 1 {
-			logger.Debug("Instances: ", len(result.AutoScalingGroups[0].Instances))
-			nInstances := len(result.AutoScalingGroups[0].Instances)
-			lastNumber = nInstances
-			return nInstances
+		instances := map[string]struct{}{}
+		for _, i := range result.AutoScalingGroups[0].Instances {
+			if aws.StringValue(i.LifecycleState) == autoscaling.LifecycleStateInService &&
+				aws.StringValue(i.HealthStatus) == asgHealthy {
+				instances[aws.StringValue(i.InstanceId)] = struct{}{}
+			}
 		}
+		logger.Debug("Healthy instances in", autoScalingName, ":", len(instances))
 
-		return lastNumber
-	}
+		if cfg.TargetGroup == "" || elb == nil {
+			return setKeys(instances), nil
+		}
+		if targetGroupArn == "" {
+			arn, err := elb.GetTargetGroupArn(cfg.TargetGroup)
+			if err != nil {
+				return nil, err
+			}
+			targetGroupArn = arn
+		}
+		registered, err := elb.GetRegisteredTargets(targetGroupArn)
+		if err != nil {
+			return nil, err
+		}
+		ids := []string{}
+		for id := range instances {
+			if _, ok := registered[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}, logger)
+}
 
+// Build the aws nodes for the running EC2 instance
+func newAwsNodesFromMetadata(cfg NodeCounterConfig, logger logging.Logger) (*lastKnownNodes, error) {
+	iid, err := NewEC2Metadata(NewAwsSession()).GetInstanceIdentityDocument()
+	if err != nil {
+		return nil, err
+	}
+	sess := NewAwsSessionWithRegion(iid.Region)
+	return newAwsNodes(NewEC2(sess), NewAutoScaling(sess), NewELBV2(sess), &iid, cfg, logger), nil
 }
 
 func NewAwsSessionWithRegion(region string) *session.Session {
@@ -111,11 +170,61 @@ func (c *EC2) GetAsgName(instanceID string) (string, error) {
 		return "", err
 	}
 
-	fmt.Println("Tags: ", len(tags.Tags))
 	if len(tags.Tags) == 0 {
 		return "", fmt.Errorf("Instance tags empty")
 	}
 
-	//fmt.Println("yeap, ", tags.Tags[0], " final")
 	return *tags.Tags[0].Value, nil
 }
+
+func NewELBV2(sess *session.Session) *ELBV2 {
+	return &ELBV2{Client: elbv2.New(sess)}
+}
+
+type ELBV2 struct {
+	Client elbv2iface.ELBV2API
+}
+
+func (c *ELBV2) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	return c.Client.DescribeTargetGroups(input)
+}
+
+func (c *ELBV2) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	return c.Client.DescribeTargetHealth(input)
+}
+
+// GetTargetGroupArn returns the ARN of the target group. The name can be an ARN already
+func (c *ELBV2) GetTargetGroupArn(name string) (string, error) {
+	if strings.HasPrefix(name, "arn:") {
+		return name, nil
+	}
+	groups, err := c.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{Names: []*string{aws.String(name)}})
+	if err != nil {
+		return "", err
+	}
+	if len(groups.TargetGroups) == 0 {
+		return "", fmt.Errorf("Target group %s not found", name)
+	}
+	return *groups.TargetGroups[0].TargetGroupArn, nil
+}
+
+// GetRegisteredTargets returns the IDs of the targets registered in the target group,
+// skipping the ones being deregistered
+func (c *ELBV2) GetRegisteredTargets(targetGroupArn string) (map[string]struct{}, error) {
+	health, err := c.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{TargetGroupArn: aws.String(targetGroupArn)})
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string]struct{}{}
+	for _, d := range health.TargetHealthDescriptions {
+		if d.Target == nil || d.TargetHealth == nil {
+			continue
+		}
+		switch aws.StringValue(d.TargetHealth.State) {
+		case elbv2.TargetHealthStateEnumDraining, elbv2.TargetHealthStateEnumUnhealthyDraining, elbv2.TargetHealthStateEnumUnused:
+			continue
+		}
+		targets[aws.StringValue(d.Target.Id)] = struct{}{}
+	}
+	return targets, nil
+}
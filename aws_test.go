@@ -6,6 +6,7 @@ package ratelimit
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,6 +15,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/devopsfaith/krakend/logging"
 )
 
 type MockedAutoscaling struct {
@@ -162,3 +166,121 @@ func TestEC2_GetAsgName(t *testing.T) {
 		})
 	}
 }
+
+type countingEC2Mock struct {
+	ec2iface.EC2API
+	calls *int
+	Resp  *ec2.DescribeTagsOutput
+}
+
+func (c countingEC2Mock) DescribeTags(input *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
+	*c.calls++
+	if c.Resp != nil {
+		return c.Resp, nil
+	}
+	return c.Resp, fmt.Errorf("Error")
+}
+
+type ELBV2Mock struct {
+	elbv2iface.ELBV2API
+	Groups *elbv2.DescribeTargetGroupsOutput
+	Health *elbv2.DescribeTargetHealthOutput
+}
+
+func (c ELBV2Mock) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	if c.Groups != nil {
+		return c.Groups, nil
+	}
+	return c.Groups, fmt.Errorf("Error")
+}
+
+func (c ELBV2Mock) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	if c.Health != nil && aws.StringValue(input.TargetGroupArn) == "arn:aws:elasticloadbalancing:tg/krakend" {
+		return c.Health, nil
+	}
+	return nil, fmt.Errorf("Error")
+}
+
+func asgInstance(id, lifecycleState, healthStatus string) *autoscaling.Instance {
+	return &autoscaling.Instance{
+		InstanceId:     aws.String(id),
+		LifecycleState: aws.String(lifecycleState),
+		HealthStatus:   aws.String(healthStatus),
+	}
+}
+
+func targetHealth(id, state string) *elbv2.TargetHealthDescription {
+	return &elbv2.TargetHealthDescription{
+		Target:       &elbv2.TargetDescription{Id: aws.String(id)},
+		TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+	}
+}
+
+func TestNewAwsNodeCounter(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	tagCalls := 0
+	ec2Client := &EC2{Client: countingEC2Mock{calls: &tagCalls, Resp: &ec2.DescribeTagsOutput{
+		Tags: []*ec2.TagDescription{{Value: aws.String("TestAsg")}},
+	}}}
+	autoScaling := &AutoScaling{Client: MockedAutoscaling{Resp: &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{{Instances: []*autoscaling.Instance{
+			asgInstance("i-1", autoscaling.LifecycleStateInService, "Healthy"),
+			asgInstance("i-2", autoscaling.LifecycleStateInService, "Healthy"),
+			asgInstance("i-3", autoscaling.LifecycleStateInService, "Healthy"),
+			asgInstance("i-4", autoscaling.LifecycleStateInService, "Unhealthy"),
+			asgInstance("i-5", autoscaling.LifecycleStatePending, "Healthy"),
+			asgInstance("i-6", autoscaling.LifecycleStateTerminating, "Healthy"),
+		}}},
+	}}}
+	elb := &ELBV2{Client: ELBV2Mock{
+		Groups: &elbv2.DescribeTargetGroupsOutput{TargetGroups: []*elbv2.TargetGroup{
+			{TargetGroupArn: aws.String("arn:aws:elasticloadbalancing:tg/krakend")},
+		}},
+		Health: &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1", elbv2.TargetHealthStateEnumHealthy),
+			targetHealth("i-2", elbv2.TargetHealthStateEnumDraining),
+			targetHealth("i-4", elbv2.TargetHealthStateEnumHealthy),
+		}},
+	}}
+	iid := &ec2metadata.EC2InstanceIdentityDocument{InstanceID: "i-1"}
+
+	checks := []struct {
+		name     string
+		cfg      NodeCounterConfig
+		expected int
+	}{
+		{name: "autoscaling group", cfg: NodeCounterConfig{}, expected: 3},
+		{name: "target group name", cfg: NodeCounterConfig{TargetGroup: "krakend"}, expected: 1},
+		{name: "target group arn", cfg: NodeCounterConfig{TargetGroup: "arn:aws:elasticloadbalancing:tg/krakend"}, expected: 1},
+		{name: "unknown target group", cfg: NodeCounterConfig{TargetGroup: "arn:aws:elasticloadbalancing:tg/other", Fallback: 2}, expected: 2},
+	}
+	for _, c := range checks {
+		tagCalls = 0
+		nodeCounter := NewAwsNodeCounterWithConfig(ec2Client, autoScaling, elb, iid, c.cfg, logger)
+		for i := 0; i < 3; i++ {
+			if n := nodeCounter(); n != c.expected {
+				t.Errorf("%s: unexpected node count (expected: %d, got: %d)", c.name, c.expected, n)
+			}
+		}
+		if tagCalls != 1 {
+			t.Errorf("%s: the autoscaling group name should be cached (DescribeTags calls: %d)", c.name, tagCalls)
+		}
+	}
+}
+
+func TestNewAwsNodeCounterFallback(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	iid := &ec2metadata.EC2InstanceIdentityDocument{InstanceID: "i-1"}
+	ec2Client := &EC2{Client: EC2Mock{Resp: &ec2.DescribeTagsOutput{Tags: []*ec2.TagDescription{{Value: aws.String("TestAsg")}}}}}
+	autoScaling := &AutoScaling{Client: MockedAutoscaling{}}
+
+	nodeCounter := NewAwsNodeCounterWithConfig(ec2Client, autoScaling, nil, iid, NodeCounterConfig{Fallback: 4}, logger)
+	if n := nodeCounter(); n != 4 {
+		t.Errorf("Unexpected fallback node count (expected: 4, got: %d)", n)
+	}
+
+	nodeCounter = NewAwsNodeCounter(&EC2{Client: EC2Mock{}}, autoScaling, iid, logger)
+	if n := nodeCounter(); n != 1 {
+		t.Errorf("Unexpected default fallback node count (expected: 1, got: %d)", n)
+	}
+}
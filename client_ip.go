@@ -0,0 +1,244 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ForwardedHeader is the RFC 7239 header (Forwarded: for=192.0.2.60;proto=http)
+	ForwardedHeader = "Forwarded"
+	// XForwardedForHeader is the list of addresses appended by every proxy
+	XForwardedForHeader = "X-Forwarded-For"
+)
+
+// ClientIPResolver finds the client IP of the requests. The forwarding headers are only
+// read when the request comes from a trusted proxy, and only the addresses appended by
+// trusted proxies are skipped, so the clients can not choose the IP they are limited by
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	hops    int
+	header  string
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+	groups  []ipGroup
+}
+
+type ipGroup struct {
+	name    string
+	network *net.IPNet
+}
+
+// defaultClientIPResolver trusts no proxy, so the client IP is the remote address
+var defaultClientIPResolver = &ClientIPResolver{header: XForwardedForHeader}
+
+// NewClientIPResolver builds the resolver of the config. Without trusted proxies nor hops,
+// the forwarding headers are ignored and the client IP is the remote address
+func NewClientIPResolver(cfg ClientIPConfig) (*ClientIPResolver, error) {
+	r := &ClientIPResolver{hops: cfg.Hops, header: http.CanonicalHeaderKey(cfg.Header)}
+	if r.header == "" {
+		r.header = XForwardedForHeader
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		network, err := parseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	if cfg.IPv4Prefix > 0 && cfg.IPv4Prefix < 8*net.IPv4len {
+		r.ipv4 = net.CIDRMask(cfg.IPv4Prefix, 8*net.IPv4len)
+	}
+	if cfg.IPv6Prefix > 0 && cfg.IPv6Prefix < 8*net.IPv6len {
+		r.ipv6 = net.CIDRMask(cfg.IPv6Prefix, 8*net.IPv6len)
+	}
+	for name, networks := range cfg.Groups {
+		for _, n := range networks {
+			network, err := parseCIDR(n)
+			if err != nil {
+				return nil, err
+			}
+			r.groups = append(r.groups, ipGroup{name: name, network: network})
+		}
+	}
+	// the most specific network wins when the groups overlap
+	sort.Slice(r.groups, func(i, j int) bool {
+		oi, _ := r.groups[i].network.Mask.Size()
+		oj, _ := r.groups[j].network.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return r.groups[i].network.String() < r.groups[j].network.String()
+	})
+	return r, nil
+}
+
+// parseCIDR parses a CIDR or a single IP (as a /32 or /128 network)
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR '%s'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP or CIDR '%s'", s)
+	}
+	return network, nil
+}
+
+// VaryBy returns a VaryByFunc using the client IP key (see Key)
+func (r *ClientIPResolver) VaryBy() VaryByFunc {
+	return func(c *gin.Context) string {
+		return r.Key(c.Request)
+	}
+}
+
+// Prefix of the group keys, so a group name can not collide with a client IP key
+const ipGroupKeyPrefix = "group:"
+
+// Key returns the rate limiter key of the client IP: the name of its group (e.g. group:office),
+// its network if the IPs are aggregated (e.g. 2001:db8:1:2::/64) or the IP itself
+func (r *ClientIPResolver) Key(req *http.Request) string {
+	ip := r.clientIP(req)
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	for _, g := range r.groups {
+		if g.network.Contains(ip) {
+			return ipGroupKeyPrefix + g.name
+		}
+	}
+	mask := r.ipv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, r.ipv4
+	}
+	if mask == nil {
+		return ip.String()
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// ClientIP walks the addresses from the remote address to the client: every address
+// added by a trusted proxy is skipped and the first untrusted one is the client IP
+func (r *ClientIPResolver) ClientIP(req *http.Request) string {
+	ip := r.clientIP(req)
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	return ip.String()
+}
+
+func (r *ClientIPResolver) clientIP(req *http.Request) net.IP {
+	remote := remoteIP(req)
+	if remote == nil {
+		return nil
+	}
+	if !r.isProxy(remote, 0) {
+		return remote
+	}
+
+	var chain []string
+	switch r.header {
+	case ForwardedHeader:
+		chain = forwardedFor(req.Header[ForwardedHeader])
+	case XForwardedForHeader:
+		chain = splitList(req.Header[XForwardedForHeader])
+	default:
+		// headers like CF-Connecting-IP hold just the client IP set by the proxy
+		if ip := parseForwardedIP(req.Header.Get(r.header)); ip != nil {
+			return ip
+		}
+		return remote
+	}
+
+	ip := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		next := parseForwardedIP(chain[i])
+		if next == nil {
+			// the proxy wrote an unexpected value: it is the closest address to trust
+			return ip
+		}
+		ip = next
+		if !r.isProxy(ip, len(chain)-i) {
+			break
+		}
+	}
+	return ip
+}
+
+// isProxy reports whether the address is a trusted proxy. hop is its distance to the
+// gateway (0 for the remote address)
+func (r *ClientIPResolver) isProxy(ip net.IP, hop int) bool {
+	if hop < r.hops {
+		return true
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// splitList splits the values of a comma separated list header
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// forwardedFor returns the for parameter of every Forwarded element. Elements without it
+// are kept as empty values, so they are not trusted
+func forwardedFor(values []string) []string {
+	elements := splitList(values)
+	list := make([]string, len(elements))
+	for i, element := range elements {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				list[i] = kv[1]
+				break
+			}
+		}
+	}
+	return list
+}
+
+// parseForwardedIP parses addresses like 192.0.2.60, "192.0.2.60:4711" or "[2001:db8::1]:4711".
+// Obfuscated identifiers (e.g. unknown or _hidden) are not valid IPs
+func parseForwardedIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
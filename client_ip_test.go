@@ -0,0 +1,302 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	lb := []string{"10.0.0.0/8", "fd00::/8"}
+	checks := []struct {
+		name     string
+		cfg      ClientIPConfig
+		remote   string
+		headers  map[string][]string
+		expected string
+	}{
+		{
+			name:     "no proxies: headers are ignored",
+			remote:   "203.0.113.7:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "untrusted remote forging the header",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "203.0.113.7:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "trusted proxy",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "client prepending a forged address",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "client forging a trusted address",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.9", "203.0.113.7"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "chain of trusted proxies",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7, 10.1.0.1, 10.2.0.1"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "only proxies",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"10.1.0.1, 10.2.0.1"}},
+			expected: "10.1.0.1",
+		},
+		{
+			name:     "garbage written by a trusted proxy",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"203.0.113.7, not-an-ip"}},
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "hops",
+			cfg:      ClientIPConfig{Hops: 2},
+			remote:   "192.0.2.1:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7, 192.0.2.2"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "hops with a missing header",
+			cfg:      ClientIPConfig{Hops: 1},
+			remote:   "192.0.2.1:5000",
+			expected: "192.0.2.1",
+		},
+		{
+			name:     "ipv6 proxy",
+			cfg:      ClientIPConfig{TrustedProxies: lb},
+			remote:   "[fd00::2]:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"2001:db8::7"}},
+			expected: "2001:db8::7",
+		},
+		{
+			name:   "forwarded",
+			cfg:    ClientIPConfig{TrustedProxies: lb, Header: "forwarded"},
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{"Forwarded": {
+				`for=198.51.100.1;proto=http, For="[2001:db8::7]:4711";by=10.0.0.3`,
+			}},
+			expected: "2001:db8::7",
+		},
+		{
+			name:   "forwarded through trusted proxies",
+			cfg:    ClientIPConfig{TrustedProxies: lb, Header: ForwardedHeader},
+			remote: "10.0.0.2:5000",
+			headers: map[string][]string{"Forwarded": {
+				`for="203.0.113.7:1234"`, `for=10.1.0.1;proto=https`,
+			}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "forwarded obfuscated identifier",
+			cfg:      ClientIPConfig{TrustedProxies: lb, Header: ForwardedHeader},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"Forwarded": {`for=_hidden`}},
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "forwarded ignores x-forwarded-for",
+			cfg:      ClientIPConfig{TrustedProxies: lb, Header: ForwardedHeader},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=203.0.113.7"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "custom header",
+			cfg:      ClientIPConfig{TrustedProxies: []string{"10.0.0.2"}, Header: "CF-Connecting-IP"},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"Cf-Connecting-Ip": {"203.0.113.7"}, "X-Forwarded-For": {"198.51.100.1"}},
+			expected: "203.0.113.7",
+		},
+		{
+			name:     "custom header from an untrusted remote",
+			cfg:      ClientIPConfig{TrustedProxies: []string{"10.0.0.2"}, Header: "CF-Connecting-IP"},
+			remote:   "10.0.0.3:5000",
+			headers:  map[string][]string{"Cf-Connecting-Ip": {"203.0.113.7"}},
+			expected: "10.0.0.3",
+		},
+		{
+			name:     "invalid custom header",
+			cfg:      ClientIPConfig{TrustedProxies: []string{"10.0.0.2"}, Header: "CF-Connecting-IP"},
+			remote:   "10.0.0.2:5000",
+			headers:  map[string][]string{"Cf-Connecting-Ip": {"localhost"}},
+			expected: "10.0.0.2",
+		},
+	}
+
+	for _, c := range checks {
+		resolver, err := NewClientIPResolver(c.cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			req.Header[k] = v
+		}
+		if ip := resolver.ClientIP(req); ip != c.expected {
+			t.Errorf("%s: unexpected client IP (expected: %s, got: %s)", c.name, c.expected, ip)
+		}
+	}
+}
+
+func TestClientIPResolverKey(t *testing.T) {
+	cfg := ClientIPConfig{
+		IPv4Prefix: 24,
+		IPv6Prefix: 64,
+		Groups: map[string][]string{
+			"office":  {"198.51.100.0/24", "2001:db8:ff::/48"},
+			"partner": {"192.0.2.0/24"},
+			"ceo":     {"198.51.100.42"},
+		},
+	}
+	checks := []struct {
+		name     string
+		cfg      ClientIPConfig
+		remote   string
+		expected string
+	}{
+		{name: "full ipv4", remote: "203.0.113.7:5000", expected: "203.0.113.7"},
+		{name: "full ipv6", remote: "[2001:db8:1:2:3::7]:5000", expected: "2001:db8:1:2:3::7"},
+		{name: "ipv4 network", cfg: cfg, remote: "203.0.113.7:5000", expected: "203.0.113.0/24"},
+		{name: "ipv6 network", cfg: cfg, remote: "[2001:db8:1:2:3::7]:5000", expected: "2001:db8:1:2::/64"},
+		{name: "same ipv6 network", cfg: cfg, remote: "[2001:db8:1:2:ffff::1]:5000", expected: "2001:db8:1:2::/64"},
+		{name: "ipv6 /56", cfg: ClientIPConfig{IPv6Prefix: 56}, remote: "[2001:db8:1:2ff::1]:5000", expected: "2001:db8:1:200::/56"},
+		{name: "ipv4 /32", cfg: ClientIPConfig{IPv4Prefix: 32, IPv6Prefix: 128}, remote: "203.0.113.7:5000", expected: "203.0.113.7"},
+		{name: "ipv4 group", cfg: cfg, remote: "192.0.2.200:5000", expected: "group:partner"},
+		{name: "ipv6 group", cfg: cfg, remote: "[2001:db8:ff:1::1]:5000", expected: "group:office"},
+		{name: "most specific group", cfg: cfg, remote: "198.51.100.42:5000", expected: "group:ceo"},
+		{name: "less specific group", cfg: cfg, remote: "198.51.100.43:5000", expected: "group:office"},
+		{name: "invalid remote", cfg: cfg, remote: "pipe", expected: "pipe"},
+	}
+
+	for _, c := range checks {
+		resolver, err := NewClientIPResolver(c.cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		if key := resolver.Key(req); key != c.expected {
+			t.Errorf("%s: unexpected key (expected: %s, got: %s)", c.name, c.expected, key)
+		}
+	}
+}
+
+func TestNewClientIPResolverInvalidProxy(t *testing.T) {
+	if _, err := NewClientIPResolver(ClientIPConfig{TrustedProxies: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("An error is expected for an invalid CIDR")
+	}
+	if _, err := NewClientIPResolver(ClientIPConfig{Groups: map[string][]string{"office": {"office.lan"}}}); err == nil {
+		t.Errorf("An error is expected for an invalid group network")
+	}
+}
+
+func TestGinIpRateLimitContextKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	varyBy := GinIpRateLimit(nil, "ClientIP").VaryBy
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request, _ = http.NewRequest("GET", "/", nil)
+	ctx.Request.RemoteAddr = "203.0.113.7:5000"
+
+	if ip := varyBy(ctx); ip != "203.0.113.7" {
+		t.Errorf("Unexpected IP without context key (expected: 203.0.113.7, got: %s)", ip)
+	}
+	ctx.Set("ClientIP", "198.51.100.1")
+	if ip := varyBy(ctx); ip != "198.51.100.1" {
+		t.Errorf("Unexpected IP from the context key (expected: 198.51.100.1, got: %s)", ip)
+	}
+}
+
+func TestGinIpRateLimitSpoofing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	newEngine := func(rl *GinRateLimiter) *gin.Engine {
+		rl.RateLimiter, _ = NewClusterAwareRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 2, period: time.Hour, burstSize: 1})
+		engine := gin.New()
+		engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+		return engine
+	}
+	trusted, err := GinIpRateLimitWithConfig(nil, "", ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	checks := []struct {
+		name     string
+		engine   *gin.Engine
+		remote   string
+		headers  map[string]string
+		expected []int
+	}{
+		{
+			name:   "forged headers",
+			engine: newEngine(GinIpRateLimit(nil, "")),
+			remote: "203.0.113.7:5000",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.%d",
+				"X-Real-Ip":       "192.0.2.%d",
+			},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "forged headers from a trusted proxy",
+			engine:   newEngine(trusted),
+			remote:   "10.0.0.1:5000",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.%d, 203.0.113.7"},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "clients of a trusted proxy",
+			engine:   newEngine(trusted),
+			remote:   "10.0.0.1:5000",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.%d"},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+	}
+	for _, c := range checks {
+		for i, expected := range c.expected {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = c.remote
+			for k, v := range c.headers {
+				req.Header.Set(k, fmt.Sprintf(v, i))
+			}
+			c.engine.ServeHTTP(w, req)
+			if w.Code != expected {
+				t.Errorf("%s: unexpected status of request %d (expected: %d, got: %d)", c.name, i, expected, w.Code)
+			}
+		}
+	}
+}
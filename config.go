@@ -5,18 +5,1127 @@
 
 package ratelimit
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+)
+
+const (
+	// Upper bound accepted for burst_size. Anything above it is almost certainly
+	// a typo and would make the limiter useless anyway
+	maxBurstSize = 1000000
+	// Upper bound accepted for period (see newRate)
+	maxPeriod = 24 * time.Hour
+	// Lower bound accepted for update_interval, so the node counters are not flooded
+	minUpdateInterval = time.Second
+)
+
+// ErrNoConfig is returned by ParseConfig when the extra config does not
+// contain the Namespace block
+var ErrNoConfig = errors.New("ratelimit: no config found for namespace " + Namespace)
+
 type RateLimitConfig struct {
 	Enabled bool                         `mapstructure:"enabled"`
 	Default RateLimitSettings            `mapstructure:"default"`
 	Custom  map[string]RateLimitSettings `mapstructure:"custom"`
+	Store   StoreConfig                  `mapstructure:"store"`
+	// UpdateInterval is how often the node count is checked. Zero means every 10 seconds
+	UpdateInterval time.Duration     `mapstructure:"update_interval"`
+	NodeCounter    NodeCounterConfig `mapstructure:"node_counter"`
+	// Split is how the limits are divided between the nodes: CeilSplit (default) or ExactSplit
+	Split   string        `mapstructure:"split"`
+	Headers HeadersConfig `mapstructure:"headers"`
+	// Denied and Error replace the default responses (see NewGinRateLimiter)
+	Denied ResponseConfig `mapstructure:"denied"`
+	Error  ResponseConfig `mapstructure:"error"`
+	// FailurePolicy is what to do when the rate limiter fails: FailClosed (default), FailOpen or FailLocal
+	FailurePolicy string         `mapstructure:"failure_policy"`
+	ClientIP      ClientIPConfig `mapstructure:"client_ip"`
+	Key           KeyConfig      `mapstructure:"key"`
+	JWT           JWTConfig      `mapstructure:"jwt"`
+	// Plans are named settings shared by the tenants mapped to them (e.g. free, pro)
+	Plans map[string]RateLimitSettings `mapstructure:"plans"`
+	// Tenants maps every tenant to its plan. They are merged with the ones of TenantsFile
+	// (the inline ones win)
+	Tenants map[string]string `mapstructure:"tenants"`
+	// TenantsFile is a JSON object or a CSV file (tenant,plan) mapping the tenants to their plan
+	TenantsFile string `mapstructure:"tenants_file"`
+	// SubLimit limits every user (or IP) within the tenant limit (see NewHierarchicalRateLimiter)
+	SubLimit SubLimitConfig `mapstructure:"sub_limit"`
+}
+
+// SubLimitConfig is the limit of every sub key (e.g. a user) within the limit of its key
+// (e.g. the tenant). It is a Fraction of the settings of the tenant or an absolute Limit
+type SubLimitConfig struct {
+	// Key selects the sub key of the requests. Without sources, it is the client IP
+	Key KeyConfig `mapstructure:"key"`
+	// Fraction of the tenant settings given to every sub key (e.g. 0.1)
+	Fraction float64 `mapstructure:"fraction"`
+	// Limit is the settings of every sub key, whatever its tenant
+	Limit RateLimitSettings `mapstructure:"limit"`
+}
+
+func (c SubLimitConfig) enabled() bool {
+	return c.Fraction > 0 || c.Limit.MaxRequests > 0 || len(c.Limit.Windows) > 0
+}
+
+const (
+	HeaderKeySource  = "header"
+	QueryKeySource   = "query"
+	ParamKeySource   = "param"
+	CookieKeySource  = "cookie"
+	ClaimKeySource   = "claim"
+	ContextKeySource = "context"
+	IPKeySource      = "ip"
+	// CompositeKeySource joins the keys of its parts (e.g. tenant:ip)
+	CompositeKeySource = "composite"
+)
+
+const (
+	// MissingKeyShared puts the requests without key in the AnonymousKey bucket
+	MissingKeyShared = "shared"
+	// MissingKeyIP uses the client IP as the key of the requests without key
+	MissingKeyIP = "ip"
+	// MissingKeyReject rejects the requests without key (see DefaultMissingKeyHandler)
+	MissingKeyReject = "reject"
+)
+
+// KeyConfig selects the rate limiter key of the requests (see NewKeyBuilder)
+type KeyConfig struct {
+	// Sources are tried in order and the first one found is the key
+	Sources []KeySource `mapstructure:"sources"`
+	// Missing is the policy for requests without key: MissingKeyShared (default),
+	// MissingKeyIP or MissingKeyReject
+	Missing string `mapstructure:"missing"`
+}
+
+// KeySource is a value of the request used as key
+type KeySource struct {
+	// Type is HeaderKeySource, QueryKeySource, ParamKeySource, CookieKeySource, ClaimKeySource,
+	// ContextKeySource, IPKeySource or CompositeKeySource
+	Type string `mapstructure:"type"`
+	// Name of the header, query parameter, path parameter, cookie, claim or context value
+	Name string `mapstructure:"name"`
+	// Parts of a CompositeKeySource. All of them must be found
+	Parts []KeySource `mapstructure:"parts"`
+}
+
+// ClientIPConfig selects the proxies trusted to forward the client IP (see NewClientIPResolver)
+type ClientIPConfig struct {
+	// TrustedProxies are the IPs or CIDRs of the proxies in front of the gateway
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// Hops is the number of proxies in front of the gateway trusted whatever their address
+	Hops int `mapstructure:"hops"`
+	// Header is XForwardedForHeader (default), ForwardedHeader or a header holding just
+	// the client IP (e.g. CF-Connecting-IP)
+	Header string `mapstructure:"header"`
+	// IPv4Prefix and IPv6Prefix aggregate the client IPs by network (e.g. 24 and 64), so a
+	// client can not get more budget by using other addresses of its network. Zero keeps the IP
+	IPv4Prefix int `mapstructure:"ipv4_prefix"`
+	IPv6Prefix int `mapstructure:"ipv6_prefix"`
+	// Groups are keys shared by every IP in their networks (e.g. an office NAT or a partner range).
+	// The key of a group is group:<name>
+	Groups map[string][]string `mapstructure:"groups"`
+}
+
+// JWTConfig verifies the bearer tokens read by the claim key sources (see NewJWTVerifier).
+// Without key sources, the requests are keyed on its Claim
+type JWTConfig struct {
+	// Claim is the key of the requests: iss (default), sub, azp or a nested claim (e.g. realm.tenant)
+	Claim string `mapstructure:"claim"`
+	// JWKFile is the path of a JSON Web Key Set with the RSA, EC or symmetric signing keys
+	JWKFile string `mapstructure:"jwk_file"`
+	// Secret is the HMAC secret of the HS256, HS384 and HS512 tokens. It must have 32 bytes
+	// at least, and as many bytes as the hash output of the algorithm (e.g. 64 for HS512)
+	Secret string `mapstructure:"secret"`
+	// Unverified decodes the tokens without checking them. Only use it if a previous layer
+	// already validated them
+	Unverified bool `mapstructure:"unverified"`
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.JWKFile != "" || c.Secret != "" || c.Unverified
+}
+
+const (
+	// FailClosed rejects the requests with the error response
+	FailClosed = "closed"
+	// FailOpen lets the requests through
+	FailOpen = "open"
+	// FailLocal limits the requests with a local in-memory rate limiter (with the per node
+	// settings) until the store recovers
+	FailLocal = "local"
+)
+
+// ResponseConfig customizes the response of the denied requests or of the rate limiter errors
+type ResponseConfig struct {
+	// StatusCode defaults to 429 for the denied requests and to 500 for the errors
+	StatusCode int `mapstructure:"status_code"`
+	// ContentType defaults to application/json. With ProblemContentType and no Body,
+	// the response is a RFC 7807 problem document
+	ContentType string `mapstructure:"content_type"`
+	// Body is a text/template executed with a ResponseData
+	Body string `mapstructure:"body"`
+}
+
+const (
+	// CeilSplit gives every node the limits divided by the node count, rounded up
+	CeilSplit = "ceil"
+	// ExactSplit gives every node the limits divided by the node count, rounded down, plus
+	// a share of the remainder depending on its NodeIndex (see ExactNodeSplit)
+	ExactSplit = "exact"
+)
+
+const (
+	// LegacyHeaders are the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers
+	LegacyHeaders = "legacy"
+	// IETFHeaders are the RateLimit and RateLimit-Policy structured fields
+	IETFHeaders = "ietf"
+	// AllHeaders are both the legacy and the IETF headers
+	AllHeaders = "both"
+	// NoHeaders hides the limits from the clients (e.g. internal clients). Retry-After is not sent either
+	NoHeaders = "none"
+
+	SecondsRetryAfter  = "seconds"
+	HTTPDateRetryAfter = "http-date"
+)
+
+// HeadersConfig selects the rate limit headers added to the responses (see GinRateLimiter)
+type HeadersConfig struct {
+	// Format is LegacyHeaders (default), IETFHeaders, AllHeaders or NoHeaders
+	Format string `mapstructure:"format"`
+	// RetryAfter is the format of the Retry-After header of the denied requests:
+	// SecondsRetryAfter (default) or HTTPDateRetryAfter
+	RetryAfter string `mapstructure:"retry_after"`
+}
+
+const (
+	MemoryStore = "memory"
+	RedisStore  = "redis"
+)
+
+// StoreConfig selects where the rate limiters keep their state (see NewRateLimiterFactory)
+type StoreConfig struct {
+	// Type is MemoryStore (default) or RedisStore
+	Type      string `mapstructure:"type"`
+	Address   string `mapstructure:"address"`
+	Password  string `mapstructure:"password"`
+	DB        int    `mapstructure:"db"`
+	KeyPrefix string `mapstructure:"key_prefix"`
+	// MaxIdle is the number of idle Redis connections kept (10 if nil)
+	MaxIdle *int `mapstructure:"max_idle"`
+}
+
+const (
+	KubernetesNodeCounter = "kubernetes"
+	DNSNodeCounter        = "dns"
+	ConsulNodeCounter     = "consul"
+	AwsNodeCounter        = "aws"
+	EcsNodeCounter        = "ecs"
+)
+
+// NodeCounterConfig selects how the cluster nodes are counted (see NewNodeCounter)
+type NodeCounterConfig struct {
+	// Type is empty (a single node), KubernetesNodeCounter, DNSNodeCounter, ConsulNodeCounter,
+	// AwsNodeCounter or EcsNodeCounter
+	Type string `mapstructure:"type"`
+	// Fallback is the node count used until the first successful count. Zero means 1
+	Fallback int `mapstructure:"fallback"`
+	// Timeout of every count request. Zero means 5 seconds
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Namespace of the kubernetes Service or pods. Empty means the namespace of the running pod
+	Namespace string `mapstructure:"namespace"`
+	// Service is the kubernetes Service, the SRV record name (e.g. _krakend._tcp.example.com),
+	// the consul service or the ECS service to count
+	Service string `mapstructure:"service"`
+	// LabelSelector counts the ready kubernetes pods matching it, when no Service is set
+	LabelSelector string `mapstructure:"label_selector"`
+	// Address of the DNS server (host:port, empty means the system resolver) or the consul
+	// agent (empty means http://127.0.0.1:8500)
+	Address string `mapstructure:"address"`
+	// Tag only counts the consul instances having it
+	Tag string `mapstructure:"tag"`
+	// TargetGroup (name or ARN) only counts the EC2 instances registered in that ELB target group
+	TargetGroup string `mapstructure:"target_group"`
+	// Cluster of the ECS service. Empty means the cluster of the running task
+	Cluster string `mapstructure:"cluster"`
+	// MinNodes and MaxNodes bound the node count. MinNodes is at least 1 and a zero MaxNodes means no limit
+	MinNodes int `mapstructure:"min_nodes"`
+	MaxNodes int `mapstructure:"max_nodes"`
+	// A lower node count is only applied once it is returned by StablePolls consecutive polls
+	// over StableFor at least (see DampedNodeCounter)
+	StablePolls int           `mapstructure:"stable_polls"`
+	StableFor   time.Duration `mapstructure:"stable_for"`
+	// PollInterval is the minimum time between two counts shared by every updater using the
+	// NodeCounter (see CachedNodeCounter). Zero means 10 seconds, the default update interval
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// NodeID is the id of the running node in the counted ones (see NewIndexedNodeCounter)
+	NodeID string `mapstructure:"node_id"`
 }
 
 type RateLimitSettings struct {
 	MaxRequests int `mapstructure:"max_requests"`
 	BurstSize   int `mapstructure:"burst_size"`
+	// Period is the time window of MaxRequests. Zero means per minute
+	Period time.Duration `mapstructure:"period"`
+	// Windows replaces the settings above with several limits that must all
+	// allow a request (e.g. 20 per second and 100000 per day)
+	Windows []RateLimitSettings `mapstructure:"windows"`
+}
+
+// BackendRateLimitConfig is the Namespace block accepted in the backend extra config
+type BackendRateLimitConfig struct {
+	RateLimitSettings `mapstructure:",squash"`
+	// PerHost keeps a different bucket for every host of the backend
+	PerHost bool `mapstructure:"per_host"`
+	// StatusCode is the status code to report when the backend is limited (see ToHTTPError)
+	StatusCode int         `mapstructure:"status_code"`
+	Store      StoreConfig `mapstructure:"store"`
+	// UpdateInterval is how often the node count is checked. Zero means every 10 seconds
+	UpdateInterval time.Duration `mapstructure:"update_interval"`
 }
 
 type RateLimiterSettings struct {
-	reqsMinute int
-	burstSize  int
+	maxRequests int
+	period      time.Duration
+	burstSize   int
+}
+
+// FieldError describes an invalid value found at Path (e.g. `$.custom["kufar.com"].max_requests`)
+type FieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// ValidationError aggregates every FieldError found while decoding the config
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return "ratelimit: invalid config: " + strings.Join(msgs, "; ")
+}
+
+// ParseConfig decodes and validates the Namespace block of the given extra config.
+// It returns ErrNoConfig if the block is missing and a ValidationError listing
+// every invalid field otherwise
+func ParseConfig(e config.ExtraConfig) (RateLimitConfig, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return RateLimitConfig{}, ErrNoConfig
+	}
+	d := &configDecoder{}
+	cfg := d.rateLimitConfig(v, "$", nil)
+	if len(d.errs) > 0 {
+		return RateLimitConfig{}, d.errs
+	}
+	return cfg, nil
+}
+
+// ParseEndpointConfig decodes and validates the Namespace block of an endpoint extra config.
+// Fields missing in the endpoint block are inherited from the service level config and
+// custom tenants declared in both places are overridden by the endpoint ones
+func ParseEndpointConfig(service RateLimitConfig, e config.ExtraConfig) (RateLimitConfig, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return RateLimitConfig{}, ErrNoConfig
+	}
+	d := &configDecoder{}
+	cfg := d.rateLimitConfig(v, "$", &service)
+	if len(d.errs) > 0 {
+		return RateLimitConfig{}, d.errs
+	}
+	return cfg, nil
+}
+
+// ParseBackendConfig decodes and validates the Namespace block of a backend extra config.
+// It returns ErrNoConfig if the block is missing and a ValidationError listing
+// every invalid field otherwise
+func ParseBackendConfig(e config.ExtraConfig) (BackendRateLimitConfig, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return BackendRateLimitConfig{}, ErrNoConfig
+	}
+	d := &configDecoder{}
+	cfg := d.backendConfig(v, "$")
+	if len(d.errs) > 0 {
+		return BackendRateLimitConfig{}, d.errs
+	}
+	return cfg, nil
+}
+
+type configDecoder struct {
+	errs ValidationError
+}
+
+func (d *configDecoder) fail(path string, format string, a ...interface{}) {
+	d.errs = append(d.errs, &FieldError{Path: path, Err: fmt.Errorf(format, a...)})
+}
+
+// rateLimitConfig decodes a Namespace block. If parent is not nil, it is used as
+// the base config and the default settings are no longer required
+func (d *configDecoder) rateLimitConfig(v interface{}, path string, parent *RateLimitConfig) RateLimitConfig {
+	cfg := RateLimitConfig{}
+	if parent != nil {
+		cfg.Enabled = parent.Enabled
+		cfg.Default = parent.Default
+		cfg.Store = parent.Store
+		cfg.UpdateInterval = parent.UpdateInterval
+		cfg.NodeCounter = parent.NodeCounter
+		cfg.Split = parent.Split
+		cfg.Headers = parent.Headers
+		cfg.Denied = parent.Denied
+		cfg.Error = parent.Error
+		cfg.FailurePolicy = parent.FailurePolicy
+		cfg.ClientIP = parent.ClientIP
+		cfg.Key = parent.Key
+		cfg.JWT = parent.JWT
+		cfg.Plans = parent.Plans
+		cfg.Tenants = parent.Tenants
+		cfg.TenantsFile = parent.TenantsFile
+		cfg.SubLimit = parent.SubLimit
+	}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["enabled"]; ok {
+		cfg.Enabled = d.bool(val, joinPath(path, "enabled"))
+	}
+	if val, ok := tmp["default"]; ok {
+		cfg.Default = d.settings(val, joinPath(path, "default"))
+	} else if parent == nil {
+		d.fail(joinPath(path, "default"), "required field")
+	}
+	if val, ok := tmp["store"]; ok {
+		cfg.Store = d.store(val, joinPath(path, "store"))
+	}
+	if val, ok := tmp["update_interval"]; ok {
+		cfg.UpdateInterval = d.updateInterval(val, joinPath(path, "update_interval"))
+	}
+	if val, ok := tmp["node_counter"]; ok {
+		cfg.NodeCounter = d.nodeCounter(val, joinPath(path, "node_counter"))
+	}
+	if val, ok := tmp["split"]; ok {
+		cfg.Split = d.string(val, joinPath(path, "split"))
+		if cfg.Split != "" && cfg.Split != CeilSplit && cfg.Split != ExactSplit {
+			d.fail(joinPath(path, "split"), "must be %s or %s (got '%s')", CeilSplit, ExactSplit, cfg.Split)
+		}
+	}
+	if val, ok := tmp["headers"]; ok {
+		cfg.Headers = d.headers(val, joinPath(path, "headers"))
+	}
+	if val, ok := tmp["denied"]; ok {
+		cfg.Denied = d.response(val, joinPath(path, "denied"))
+	}
+	if val, ok := tmp["error"]; ok {
+		cfg.Error = d.response(val, joinPath(path, "error"))
+	}
+	if val, ok := tmp["failure_policy"]; ok {
+		cfg.FailurePolicy = d.string(val, joinPath(path, "failure_policy"))
+		switch cfg.FailurePolicy {
+		case "", FailClosed, FailOpen, FailLocal:
+		default:
+			d.fail(joinPath(path, "failure_policy"), "must be %s, %s or %s (got '%s')",
+				FailClosed, FailOpen, FailLocal, cfg.FailurePolicy)
+		}
+	}
+	if val, ok := tmp["client_ip"]; ok {
+		cfg.ClientIP = d.clientIP(val, joinPath(path, "client_ip"))
+	}
+	if val, ok := tmp["key"]; ok {
+		cfg.Key = d.key(val, joinPath(path, "key"))
+	}
+	if val, ok := tmp["jwt"]; ok {
+		cfg.JWT = d.jwt(val, joinPath(path, "jwt"))
+	}
+	if val, ok := tmp["plans"]; ok {
+		cfg.Plans = d.plans(val, joinPath(path, "plans"))
+	}
+	if val, ok := tmp["tenants"]; ok {
+		cfg.Tenants = d.tenants(val, joinPath(path, "tenants"), cfg.Plans)
+	}
+	if val, ok := tmp["tenants_file"]; ok {
+		cfg.TenantsFile = d.string(val, joinPath(path, "tenants_file"))
+		if cfg.TenantsFile != "" && len(cfg.Plans) == 0 {
+			d.fail(joinPath(path, "plans"), "required field")
+		}
+	}
+	if val, ok := tmp["sub_limit"]; ok {
+		cfg.SubLimit = d.subLimit(val, joinPath(path, "sub_limit"))
+	}
+	if parent != nil && len(parent.Custom) > 0 {
+		cfg.Custom = make(map[string]RateLimitSettings, len(parent.Custom))
+		for k, s := range parent.Custom {
+			cfg.Custom[k] = s
+		}
+	}
+	if val, ok := tmp["custom"]; ok {
+		cfg.Custom = d.customSettings(val, joinPath(path, "custom"), cfg.Custom)
+	}
+	return cfg
+}
+
+// customSettings decodes the custom tenant settings into dst (allocating it if nil)
+func (d *configDecoder) customSettings(v interface{}, path string, dst map[string]RateLimitSettings) map[string]RateLimitSettings {
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]RateLimitSettings, len(tmp))
+	}
+	for _, k := range sortedKeys(tmp) {
+		val := tmp[k]
+		kPath := path + "[" + strconv.Quote(k) + "]"
+		if _, ok := tenantSuffixOf(k); !ok && isTenantPattern(k) {
+			if _, err := compileTenantPattern(k); err != nil {
+				d.fail(kPath, "invalid pattern: %s", err.Error())
+			}
+		}
+		dst[k] = d.settings(val, kPath)
+	}
+	return dst
+}
+
+func (d *configDecoder) plans(v interface{}, path string) map[string]RateLimitSettings {
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return nil
+	}
+	plans := make(map[string]RateLimitSettings, len(tmp))
+	for _, name := range sortedKeys(tmp) {
+		plans[name] = d.settings(tmp[name], path+"["+strconv.Quote(name)+"]")
+	}
+	return plans
+}
+
+// tenants decodes the tenant to plan mapping. Every plan must be defined
+func (d *configDecoder) tenants(v interface{}, path string, plans map[string]RateLimitSettings) map[string]string {
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return nil
+	}
+	tenants := make(map[string]string, len(tmp))
+	for _, tenant := range sortedKeys(tmp) {
+		val := tmp[tenant]
+		tPath := path + "[" + strconv.Quote(tenant) + "]"
+		plan, ok := val.(string)
+		if !ok {
+			d.fail(tPath, "expected a string, got %T", val)
+			continue
+		}
+		if _, ok := plans[plan]; !ok {
+			d.fail(tPath, "unknown plan '%s'", plan)
+		}
+		tenants[tenant] = plan
+	}
+	return tenants
+}
+
+func (d *configDecoder) settings(v interface{}, path string) RateLimitSettings {
+	settings := RateLimitSettings{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return settings
+	}
+
+	if val, ok := tmp["windows"]; ok {
+		for _, k := range []string{"max_requests", "burst_size", "period"} {
+			if _, ok := tmp[k]; ok {
+				d.fail(joinPath(path, k), "cannot be used together with windows")
+			}
+		}
+		settings.Windows = d.windows(val, joinPath(path, "windows"))
+		return settings
+	}
+
+	if val, ok := tmp["max_requests"]; !ok {
+		d.fail(joinPath(path, "max_requests"), "required field")
+	} else if n, ok := d.int(val, joinPath(path, "max_requests")); ok {
+		if n <= 0 {
+			d.fail(joinPath(path, "max_requests"), "must be greater than 0 (got %d)", n)
+		}
+		settings.MaxRequests = n
+	}
+
+	if val, ok := tmp["burst_size"]; ok {
+		if n, ok := d.int(val, joinPath(path, "burst_size")); ok {
+			if n < 0 || n > maxBurstSize {
+				d.fail(joinPath(path, "burst_size"), "must be between 0 and %d (got %d)", maxBurstSize, n)
+			}
+			settings.BurstSize = n
+		}
+	}
+
+	if val, ok := tmp["period"]; ok {
+		if p, ok := d.duration(val, joinPath(path, "period")); ok {
+			if p <= 0 || p > maxPeriod {
+				d.fail(joinPath(path, "period"), "must be greater than 0 and up to %s (got %s)", maxPeriod, p)
+			}
+			settings.Period = p
+		}
+	}
+	return settings
+}
+
+func (d *configDecoder) windows(v interface{}, path string) []RateLimitSettings {
+	tmp, ok := v.([]interface{})
+	if !ok {
+		d.fail(path, "expected an array, got %T", v)
+		return nil
+	}
+	if len(tmp) == 0 {
+		d.fail(path, "at least one window is required")
+		return nil
+	}
+	windows := make([]RateLimitSettings, len(tmp))
+	for i, val := range tmp {
+		wPath := path + "[" + strconv.Itoa(i) + "]"
+		if w, ok := val.(map[string]interface{}); ok {
+			if _, ok := w["windows"]; ok {
+				d.fail(joinPath(wPath, "windows"), "windows cannot be nested")
+				continue
+			}
+		}
+		windows[i] = d.settings(val, wPath)
+	}
+	return windows
+}
+
+func (d *configDecoder) backendConfig(v interface{}, path string) BackendRateLimitConfig {
+	cfg := BackendRateLimitConfig{StatusCode: http.StatusTooManyRequests}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	cfg.RateLimitSettings = d.settings(tmp, path)
+	if val, ok := tmp["per_host"]; ok {
+		cfg.PerHost = d.bool(val, joinPath(path, "per_host"))
+	}
+	if val, ok := tmp["status_code"]; ok {
+		if n, ok := d.int(val, joinPath(path, "status_code")); ok {
+			if n < 400 || n > 599 {
+				d.fail(joinPath(path, "status_code"), "must be a 4xx or 5xx status code (got %d)", n)
+			}
+			cfg.StatusCode = n
+		}
+	}
+	if val, ok := tmp["store"]; ok {
+		cfg.Store = d.store(val, joinPath(path, "store"))
+	}
+	if val, ok := tmp["update_interval"]; ok {
+		cfg.UpdateInterval = d.updateInterval(val, joinPath(path, "update_interval"))
+	}
+	if _, ok := tmp["sub_limit"]; ok {
+		d.fail(joinPath(path, "sub_limit"), "not supported by the backend rate limits (the backend requests have no sub key)")
+	}
+	return cfg
+}
+
+func (d *configDecoder) updateInterval(v interface{}, path string) time.Duration {
+	p, ok := d.duration(v, path)
+	if ok && p < minUpdateInterval {
+		d.fail(path, "must be at least %s (got %s)", minUpdateInterval, p)
+	}
+	return p
+}
+
+func (d *configDecoder) headers(v interface{}, path string) HeadersConfig {
+	cfg := HeadersConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["format"]; ok {
+		cfg.Format = d.string(val, joinPath(path, "format"))
+		switch cfg.Format {
+		case "", LegacyHeaders, IETFHeaders, AllHeaders, NoHeaders:
+		default:
+			d.fail(joinPath(path, "format"), "must be %s, %s, %s or %s (got '%s')",
+				LegacyHeaders, IETFHeaders, AllHeaders, NoHeaders, cfg.Format)
+		}
+	}
+	if val, ok := tmp["retry_after"]; ok {
+		cfg.RetryAfter = d.string(val, joinPath(path, "retry_after"))
+		if cfg.RetryAfter != "" && cfg.RetryAfter != SecondsRetryAfter && cfg.RetryAfter != HTTPDateRetryAfter {
+			d.fail(joinPath(path, "retry_after"), "must be %s or %s (got '%s')", SecondsRetryAfter, HTTPDateRetryAfter, cfg.RetryAfter)
+		}
+	}
+	return cfg
+}
+
+func (d *configDecoder) response(v interface{}, path string) ResponseConfig {
+	cfg := ResponseConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["status_code"]; ok {
+		if n, ok := d.int(val, joinPath(path, "status_code")); ok {
+			if n < 400 || n > 599 {
+				d.fail(joinPath(path, "status_code"), "must be a 4xx or 5xx status code (got %d)", n)
+			}
+			cfg.StatusCode = n
+		}
+	}
+	if val, ok := tmp["content_type"]; ok {
+		cfg.ContentType = d.string(val, joinPath(path, "content_type"))
+	}
+	if val, ok := tmp["body"]; ok {
+		cfg.Body = d.string(val, joinPath(path, "body"))
+		if _, err := parseResponseBody(cfg.Body); err != nil {
+			d.fail(joinPath(path, "body"), "invalid template: %s", err.Error())
+		}
+	}
+	return cfg
+}
+
+func (d *configDecoder) clientIP(v interface{}, path string) ClientIPConfig {
+	cfg := ClientIPConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["trusted_proxies"]; ok {
+		cfg.TrustedProxies = d.cidrs(val, joinPath(path, "trusted_proxies"))
+	}
+	if val, ok := tmp["hops"]; ok {
+		if n, ok := d.int(val, joinPath(path, "hops")); ok {
+			if n < 0 {
+				d.fail(joinPath(path, "hops"), "must be greater or equal than 0 (got %d)", n)
+			}
+			cfg.Hops = n
+		}
+	}
+	if val, ok := tmp["header"]; ok {
+		cfg.Header = d.string(val, joinPath(path, "header"))
+	}
+	for _, key := range []string{"ipv4_prefix", "ipv6_prefix"} {
+		bits := 8 * net.IPv4len
+		if key == "ipv6_prefix" {
+			bits = 8 * net.IPv6len
+		}
+		val, ok := tmp[key]
+		if !ok {
+			continue
+		}
+		if n, ok := d.int(val, joinPath(path, key)); ok {
+			if n < 0 || n > bits {
+				d.fail(joinPath(path, key), "must be between 0 and %d (got %d)", bits, n)
+			}
+			if key == "ipv4_prefix" {
+				cfg.IPv4Prefix = n
+			} else {
+				cfg.IPv6Prefix = n
+			}
+		}
+	}
+	if val, ok := tmp["groups"]; ok {
+		if groups, ok := d.object(val, joinPath(path, "groups")); ok {
+			cfg.Groups = make(map[string][]string, len(groups))
+			for _, name := range sortedKeys(groups) {
+				cfg.Groups[name] = d.cidrs(groups[name], joinPath(path, "groups")+"["+strconv.Quote(name)+"]")
+			}
+		}
+	}
+	return cfg
+}
+
+// cidrs decodes a list of IPs or CIDRs
+func (d *configDecoder) cidrs(v interface{}, path string) []string {
+	list := d.strings(v, path)
+	raw, _ := v.([]interface{})
+	for i, s := range list {
+		// items that are not strings already failed
+		if _, ok := raw[i].(string); !ok {
+			continue
+		}
+		if _, err := parseCIDR(s); err != nil {
+			d.fail(path+"["+strconv.Itoa(i)+"]", "%s", err.Error())
+		}
+	}
+	return list
+}
+
+func (d *configDecoder) key(v interface{}, path string) KeyConfig {
+	cfg := KeyConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["sources"]; ok {
+		cfg.Sources = d.keySources(val, joinPath(path, "sources"), true)
+	}
+	if val, ok := tmp["missing"]; ok {
+		cfg.Missing = d.string(val, joinPath(path, "missing"))
+		switch cfg.Missing {
+		case "", MissingKeyShared, MissingKeyIP, MissingKeyReject:
+		default:
+			d.fail(joinPath(path, "missing"), "must be %s, %s or %s (got '%s')",
+				MissingKeyShared, MissingKeyIP, MissingKeyReject, cfg.Missing)
+		}
+	}
+	return cfg
+}
+
+func (d *configDecoder) subLimit(v interface{}, path string) SubLimitConfig {
+	cfg := SubLimitConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["key"]; ok {
+		cfg.Key = d.key(val, joinPath(path, "key"))
+	}
+	fraction, hasFraction := tmp["fraction"]
+	limit, hasLimit := tmp["limit"]
+	switch {
+	case hasFraction && hasLimit:
+		d.fail(path, "fraction and limit are mutually exclusive")
+	case hasFraction:
+		f, ok := d.float(fraction, joinPath(path, "fraction"))
+		if ok && (f <= 0 || f > 1) {
+			d.fail(joinPath(path, "fraction"), "must be greater than 0 and lower or equal than 1 (got %g)", f)
+		}
+		cfg.Fraction = f
+	case hasLimit:
+		cfg.Limit = d.settings(limit, joinPath(path, "limit"))
+	default:
+		d.fail(path, "a fraction or a limit is required")
+	}
+	return cfg
+}
+
+func (d *configDecoder) jwt(v interface{}, path string) JWTConfig {
+	cfg := JWTConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["claim"]; ok {
+		cfg.Claim = d.string(val, joinPath(path, "claim"))
+	}
+	if val, ok := tmp["jwk_file"]; ok {
+		cfg.JWKFile = d.string(val, joinPath(path, "jwk_file"))
+	}
+	if val, ok := tmp["secret"]; ok {
+		cfg.Secret = d.string(val, joinPath(path, "secret"))
+		if cfg.Secret != "" && len(cfg.Secret) < minJWTSecretSize {
+			d.fail(joinPath(path, "secret"), "must have %d bytes at least (got %d)", minJWTSecretSize, len(cfg.Secret))
+		}
+	}
+	if val, ok := tmp["unverified"]; ok {
+		cfg.Unverified = d.bool(val, joinPath(path, "unverified"))
+	}
+	n := 0
+	for _, set := range []bool{cfg.JWKFile != "", cfg.Secret != "", cfg.Unverified} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		d.fail(path, "exactly one of jwk_file, secret or unverified is required")
+	}
+	return cfg
+}
+
+// keySources decodes a list of key sources. Composite sources are only accepted at the top level
+func (d *configDecoder) keySources(v interface{}, path string, composite bool) []KeySource {
+	tmp, ok := v.([]interface{})
+	if !ok {
+		d.fail(path, "expected an array, got %T", v)
+		return nil
+	}
+	if len(tmp) == 0 {
+		d.fail(path, "at least one source is required")
+		return nil
+	}
+	sources := make([]KeySource, len(tmp))
+	for i, val := range tmp {
+		sPath := path + "[" + strconv.Itoa(i) + "]"
+		s, ok := d.object(val, sPath)
+		if !ok {
+			continue
+		}
+		if t, ok := s["type"]; ok {
+			sources[i].Type = d.string(t, joinPath(sPath, "type"))
+		}
+		if n, ok := s["name"]; ok {
+			sources[i].Name = d.string(n, joinPath(sPath, "name"))
+		}
+		switch sources[i].Type {
+		case HeaderKeySource, QueryKeySource, ParamKeySource, CookieKeySource, ClaimKeySource, ContextKeySource:
+			if sources[i].Name == "" {
+				d.fail(joinPath(sPath, "name"), "required field")
+			}
+		case IPKeySource:
+		case CompositeKeySource:
+			if !composite {
+				d.fail(joinPath(sPath, "type"), "composite sources cannot be nested")
+			} else if parts, ok := s["parts"]; ok {
+				sources[i].Parts = d.keySources(parts, joinPath(sPath, "parts"), false)
+			} else {
+				d.fail(joinPath(sPath, "parts"), "required field")
+			}
+		default:
+			d.fail(joinPath(sPath, "type"), "unknown key source type '%s'", sources[i].Type)
+		}
+	}
+	return sources
+}
+
+func (d *configDecoder) store(v interface{}, path string) StoreConfig {
+	cfg := StoreConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["type"]; ok {
+		cfg.Type = d.string(val, joinPath(path, "type"))
+	}
+	if val, ok := tmp["address"]; ok {
+		cfg.Address = d.string(val, joinPath(path, "address"))
+	}
+	if val, ok := tmp["password"]; ok {
+		cfg.Password = d.string(val, joinPath(path, "password"))
+	}
+	if val, ok := tmp["key_prefix"]; ok {
+		cfg.KeyPrefix = d.string(val, joinPath(path, "key_prefix"))
+	}
+	if val, ok := tmp["db"]; ok {
+		if n, ok := d.int(val, joinPath(path, "db")); ok {
+			if n < 0 {
+				d.fail(joinPath(path, "db"), "must be greater or equal than 0 (got %d)", n)
+			}
+			cfg.DB = n
+		}
+	}
+	if val, ok := tmp["max_idle"]; ok {
+		if n, ok := d.int(val, joinPath(path, "max_idle")); ok {
+			if n < 0 {
+				d.fail(joinPath(path, "max_idle"), "must be greater or equal than 0 (got %d)", n)
+			}
+			cfg.MaxIdle = &n
+		}
+	}
+
+	switch cfg.Type {
+	case "", MemoryStore:
+	case RedisStore:
+		if cfg.Address == "" {
+			d.fail(joinPath(path, "address"), "required field for %s store", RedisStore)
+		}
+	default:
+		d.fail(joinPath(path, "type"), "unknown store type '%s'", cfg.Type)
+	}
+	return cfg
+}
+
+func (d *configDecoder) nodeCounter(v interface{}, path string) NodeCounterConfig {
+	cfg := NodeCounterConfig{}
+	tmp, ok := d.object(v, path)
+	if !ok {
+		return cfg
+	}
+	if val, ok := tmp["type"]; ok {
+		cfg.Type = d.string(val, joinPath(path, "type"))
+	}
+	if val, ok := tmp["fallback"]; ok {
+		if n, ok := d.int(val, joinPath(path, "fallback")); ok {
+			if n < 0 {
+				d.fail(joinPath(path, "fallback"), "must be greater or equal than 0 (got %d)", n)
+			}
+			cfg.Fallback = n
+		}
+	}
+	if val, ok := tmp["timeout"]; ok {
+		if p, ok := d.duration(val, joinPath(path, "timeout")); ok {
+			if p <= 0 {
+				d.fail(joinPath(path, "timeout"), "must be greater than 0 (got %s)", p)
+			}
+			cfg.Timeout = p
+		}
+	}
+	if val, ok := tmp["namespace"]; ok {
+		cfg.Namespace = d.string(val, joinPath(path, "namespace"))
+	}
+	if val, ok := tmp["service"]; ok {
+		cfg.Service = d.string(val, joinPath(path, "service"))
+	}
+	if val, ok := tmp["label_selector"]; ok {
+		cfg.LabelSelector = d.string(val, joinPath(path, "label_selector"))
+	}
+	if val, ok := tmp["address"]; ok {
+		cfg.Address = d.string(val, joinPath(path, "address"))
+	}
+	if val, ok := tmp["tag"]; ok {
+		cfg.Tag = d.string(val, joinPath(path, "tag"))
+	}
+	if val, ok := tmp["target_group"]; ok {
+		cfg.TargetGroup = d.string(val, joinPath(path, "target_group"))
+	}
+	if val, ok := tmp["cluster"]; ok {
+		cfg.Cluster = d.string(val, joinPath(path, "cluster"))
+	}
+	if val, ok := tmp["node_id"]; ok {
+		cfg.NodeID = d.string(val, joinPath(path, "node_id"))
+	}
+	for _, f := range []struct {
+		key string
+		dst *int
+	}{
+		{key: "max_nodes", dst: &cfg.MaxNodes},
+		{key: "min_nodes", dst: &cfg.MinNodes},
+		{key: "stable_polls", dst: &cfg.StablePolls},
+	} {
+		if val, ok := tmp[f.key]; ok {
+			if n, ok := d.int(val, joinPath(path, f.key)); ok {
+				if n < 0 {
+					d.fail(joinPath(path, f.key), "must be greater or equal than 0 (got %d)", n)
+				}
+				*f.dst = n
+			}
+		}
+	}
+	if cfg.MaxNodes > 0 && cfg.MaxNodes < cfg.MinNodes {
+		d.fail(joinPath(path, "max_nodes"), "must be greater or equal than min_nodes (got %d < %d)", cfg.MaxNodes, cfg.MinNodes)
+	}
+	if val, ok := tmp["stable_for"]; ok {
+		if p, ok := d.duration(val, joinPath(path, "stable_for")); ok {
+			if p < 0 {
+				d.fail(joinPath(path, "stable_for"), "must be greater or equal than 0 (got %s)", p)
+			}
+			cfg.StableFor = p
+		}
+	}
+	if val, ok := tmp["poll_interval"]; ok {
+		cfg.PollInterval = d.updateInterval(val, joinPath(path, "poll_interval"))
+	}
+
+	switch cfg.Type {
+	case "", AwsNodeCounter, EcsNodeCounter:
+	case KubernetesNodeCounter:
+		if (cfg.Service == "") == (cfg.LabelSelector == "") {
+			d.fail(path, "exactly one of service or label_selector is required for %s node counter", KubernetesNodeCounter)
+		}
+	case DNSNodeCounter, ConsulNodeCounter:
+		if cfg.Service == "" {
+			d.fail(joinPath(path, "service"), "required field for %s node counter", cfg.Type)
+		}
+	default:
+		d.fail(joinPath(path, "type"), "unknown node counter type '%s'", cfg.Type)
+	}
+	return cfg
+}
+
+func (d *configDecoder) object(v interface{}, path string) (map[string]interface{}, bool) {
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		d.fail(path, "expected an object, got %T", v)
+	}
+	return tmp, ok
+}
+
+func (d *configDecoder) bool(v interface{}, path string) bool {
+	b, ok := v.(bool)
+	if !ok {
+		d.fail(path, "expected a boolean, got %T", v)
+	}
+	return b
+}
+
+func (d *configDecoder) string(v interface{}, path string) string {
+	s, ok := v.(string)
+	if !ok {
+		d.fail(path, "expected a string, got %T", v)
+	}
+	return s
+}
+
+func (d *configDecoder) strings(v interface{}, path string) []string {
+	tmp, ok := v.([]interface{})
+	if !ok {
+		d.fail(path, "expected an array, got %T", v)
+		return nil
+	}
+	list := make([]string, len(tmp))
+	for i, val := range tmp {
+		list[i] = d.string(val, path+"["+strconv.Itoa(i)+"]")
+	}
+	return list
+}
+
+func (d *configDecoder) int(v interface{}, path string) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) <= math.MaxInt32 {
+			return int(n), true
+		}
+		d.fail(path, "expected an integer, got %v", n)
+	default:
+		d.fail(path, "expected an integer, got %T", v)
+	}
+	return 0, false
+}
+
+func (d *configDecoder) float(v interface{}, path string) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	d.fail(path, "expected a number, got %T", v)
+	return 0, false
+}
+
+func (d *configDecoder) duration(v interface{}, path string) (time.Duration, bool) {
+	s, ok := v.(string)
+	if !ok {
+		d.fail(path, "expected a duration string, got %T", v)
+		return 0, false
+	}
+	p, err := time.ParseDuration(s)
+	if err != nil {
+		d.fail(path, "%s", err.Error())
+		return 0, false
+	}
+	return p, true
+}
+
+func joinPath(path, key string) string {
+	return path + "." + key
+}
+
+// sortedKeys returns the keys of a JSON object in order, so the validation errors are
+// always reported in the same order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
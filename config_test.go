@@ -0,0 +1,376 @@
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+package ratelimit
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+)
+
+func parseExtraConfig(t *testing.T, raw string) config.ExtraConfig {
+	extra := config.ExtraConfig{}
+	if err := json.Unmarshal([]byte(raw), &extra); err != nil {
+		t.Fatalf("Unable to parse test extra config: %s", err.Error())
+	}
+	return extra
+}
+
+func TestParseConfig(t *testing.T) {
+	extra := parseExtraConfig(t, `{
+		"github.com/schibsted/krakend-ratelimit": {
+			"enabled": true,
+			"default": {"max_requests": 600, "burst_size": 5},
+			"store": {"type": "redis", "address": "localhost:6379", "db": 2, "key_prefix": "rl:"},
+			"update_interval": "30s",
+			"split": "exact",
+			"headers": {"format": "both", "retry_after": "http-date"},
+			"denied": {"status_code": 503, "content_type": "application/problem+json"},
+			"error": {"content_type": "text/plain", "body": "{{.Error}}"},
+			"failure_policy": "local",
+			"client_ip": {
+				"trusted_proxies": ["10.0.0.0/8", "192.0.2.1"], "hops": 1, "header": "Forwarded",
+				"ipv4_prefix": 24, "ipv6_prefix": 56, "groups": {"office": ["198.51.100.0/24"]}
+			},
+			"key": {
+				"sources": [
+					{"type": "header", "name": "X-Api-Key"},
+					{"type": "composite", "parts": [{"type": "claim", "name": "iss"}, {"type": "ip"}]}
+				],
+				"missing": "reject"
+			},
+			"jwt": {"claim": "realm.tenant", "jwk_file": "/etc/krakend/jwks.json"},
+			"plans": {"free": {"max_requests": 10}, "pro": {"max_requests": 100, "burst_size": 10}},
+			"tenants": {"kufar.by": "pro"},
+			"tenants_file": "/etc/krakend/tenants.csv",
+			"sub_limit": {"key": {"sources": [{"type": "header", "name": "X-User"}]}, "fraction": 0.1},
+			"node_counter": {"type": "kubernetes", "namespace": "gateway", "service": "krakend", "fallback": 3, "timeout": "2s", "node_id": "krakend-0", "poll_interval": "30s"},
+			"custom": {
+				"kufar.com": {"max_requests": 60, "burst_size": 10},
+				"corotos.com": {"max_requests": 40, "period": "1s"},
+				"partner.com": {"windows": [
+					{"max_requests": 20, "period": "1s"},
+					{"max_requests": 100000, "period": "24h"}
+				]}
+			}
+		}
+	}`)
+
+	got, err := ParseConfig(extra)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := RateLimitConfig{
+		Enabled:        true,
+		Default:        RateLimitSettings{MaxRequests: 600, BurstSize: 5},
+		Store:          StoreConfig{Type: RedisStore, Address: "localhost:6379", DB: 2, KeyPrefix: "rl:"},
+		UpdateInterval: 30 * time.Second,
+		Split:          ExactSplit,
+		Headers:        HeadersConfig{Format: AllHeaders, RetryAfter: HTTPDateRetryAfter},
+		Denied:         ResponseConfig{StatusCode: 503, ContentType: ProblemContentType},
+		Error:          ResponseConfig{ContentType: "text/plain", Body: "{{.Error}}"},
+		FailurePolicy:  FailLocal,
+		ClientIP: ClientIPConfig{
+			TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"},
+			Hops:           1,
+			Header:         ForwardedHeader,
+			IPv4Prefix:     24,
+			IPv6Prefix:     56,
+			Groups:         map[string][]string{"office": {"198.51.100.0/24"}},
+		},
+		Key: KeyConfig{
+			Sources: []KeySource{
+				{Type: HeaderKeySource, Name: "X-Api-Key"},
+				{Type: CompositeKeySource, Parts: []KeySource{{Type: ClaimKeySource, Name: "iss"}, {Type: IPKeySource}}},
+			},
+			Missing: MissingKeyReject,
+		},
+		JWT: JWTConfig{Claim: "realm.tenant", JWKFile: "/etc/krakend/jwks.json"},
+		Plans: map[string]RateLimitSettings{
+			"free": {MaxRequests: 10},
+			"pro":  {MaxRequests: 100, BurstSize: 10},
+		},
+		Tenants:     map[string]string{"kufar.by": "pro"},
+		TenantsFile: "/etc/krakend/tenants.csv",
+		SubLimit: SubLimitConfig{
+			Key:      KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-User"}}},
+			Fraction: 0.1,
+		},
+		NodeCounter: NodeCounterConfig{
+			Type:         KubernetesNodeCounter,
+			Namespace:    "gateway",
+			Service:      "krakend",
+			Fallback:     3,
+			Timeout:      2 * time.Second,
+			NodeID:       "krakend-0",
+			PollInterval: 30 * time.Second,
+		},
+		Custom: map[string]RateLimitSettings{
+			"kufar.com":   {MaxRequests: 60, BurstSize: 10},
+			"corotos.com": {MaxRequests: 40, Period: time.Second},
+			"partner.com": {Windows: []RateLimitSettings{
+				{MaxRequests: 20, Period: time.Second},
+				{MaxRequests: 100000, Period: 24 * time.Hour},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected config (expected: %+v, got: %+v)", expected, got)
+	}
+	if cfg, ok := ConfigGetter(extra).(RateLimitConfig); !ok || !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("ConfigGetter returned unexpected config: %+v", cfg)
+	}
+}
+
+func TestParseConfigNoNamespace(t *testing.T) {
+	if _, err := ParseConfig(config.ExtraConfig{}); err != ErrNoConfig {
+		t.Errorf("Unexpected error (expected: %v, got: %v)", ErrNoConfig, err)
+	}
+	if cfg := ConfigGetter(config.ExtraConfig{}); cfg != nil {
+		t.Errorf("Unexpected config (expected: nil, got: %+v)", cfg)
+	}
+}
+
+func TestParseConfigValidationErrors(t *testing.T) {
+	checks := []struct {
+		name     string
+		raw      string
+		expected []string
+	}{
+		{
+			name:     "not an object",
+			raw:      `"enabled"`,
+			expected: []string{"$"},
+		},
+		{
+			name:     "missing default",
+			raw:      `{"enabled": true}`,
+			expected: []string{"$.default"},
+		},
+		{
+			name:     "wrong types",
+			raw:      `{"enabled": "yes", "default": {"max_requests": "600", "burst_size": 1.5, "period": 60}}`,
+			expected: []string{"$.enabled", "$.default.max_requests", "$.default.burst_size", "$.default.period"},
+		},
+		{
+			name:     "invalid store",
+			raw:      `{"default": {"max_requests": 10}, "store": {"type": "memcached", "db": -1, "max_idle": "10"}}`,
+			expected: []string{"$.store.type", "$.store.db", "$.store.max_idle"},
+		},
+		{
+			name:     "invalid update interval",
+			raw:      `{"default": {"max_requests": 10}, "update_interval": "10ms"}`,
+			expected: []string{"$.update_interval"},
+		},
+		{
+			name:     "invalid split",
+			raw:      `{"default": {"max_requests": 10}, "split": "floor", "node_counter": {"node_id": 1}}`,
+			expected: []string{"$.split", "$.node_counter.node_id"},
+		},
+		{
+			name:     "invalid headers",
+			raw:      `{"default": {"max_requests": 10}, "headers": {"format": "draft", "retry_after": "minutes"}}`,
+			expected: []string{"$.headers.format", "$.headers.retry_after"},
+		},
+		{
+			name:     "invalid responses",
+			raw:      `{"default": {"max_requests": 10}, "denied": {"status_code": 200, "body": "{{.Key"}, "error": {"content_type": 1}}`,
+			expected: []string{"$.denied.status_code", "$.denied.body", "$.error.content_type"},
+		},
+		{
+			name:     "invalid failure policy",
+			raw:      `{"default": {"max_requests": 10}, "failure_policy": "ignore"}`,
+			expected: []string{"$.failure_policy"},
+		},
+		{
+			name:     "invalid client ip",
+			raw:      `{"default": {"max_requests": 10}, "client_ip": {"trusted_proxies": ["10.0.0.0/8", "lb", 3], "hops": -1}}`,
+			expected: []string{"$.client_ip.trusted_proxies[1]", "$.client_ip.trusted_proxies[2]", "$.client_ip.hops"},
+		},
+		{
+			name: "invalid client ip aggregation",
+			raw: `{"default": {"max_requests": 10}, "client_ip": {
+				"ipv4_prefix": 33, "ipv6_prefix": -1, "groups": {"office": ["office.lan"], "partner": "192.0.2.0/24"}
+			}}`,
+			expected: []string{
+				"$.client_ip.ipv4_prefix",
+				"$.client_ip.ipv6_prefix",
+				`$.client_ip.groups["office"][0]`,
+				`$.client_ip.groups["partner"]`,
+			},
+		},
+		{
+			name: "invalid key",
+			raw: `{"default": {"max_requests": 10}, "key": {"missing": "drop", "sources": [
+				{"type": "header"},
+				{"type": "body", "name": "tenant"},
+				{"type": "composite"},
+				{"type": "composite", "parts": [{"type": "composite", "parts": []}, {"type": "ip"}]},
+				"ip"
+			]}}`,
+			expected: []string{
+				"$.key.missing",
+				"$.key.sources[0].name",
+				"$.key.sources[1].type",
+				"$.key.sources[2].parts",
+				"$.key.sources[3].parts[0].type",
+				"$.key.sources[4]",
+			},
+		},
+		{
+			name:     "invalid custom pattern",
+			raw:      `{"default": {"max_requests": 10}, "custom": {"~tenant-(": {"max_requests": 1}, "*.kufar.com": {"max_requests": 1}}}`,
+			expected: []string{`$.custom["~tenant-("]`},
+		},
+		{
+			name: "invalid plans",
+			raw: `{"default": {"max_requests": 10}, "plans": {"free": {"max_requests": 0}},
+				"tenants": {"kufar.com": "free", "corotos.com": "pro", "kufar.by": 1}}`,
+			expected: []string{
+				`$.plans["free"].max_requests`,
+				`$.tenants["corotos.com"]`,
+				`$.tenants["kufar.by"]`,
+			},
+		},
+		{
+			name:     "tenants file without plans",
+			raw:      `{"default": {"max_requests": 10}, "tenants_file": "tenants.csv"}`,
+			expected: []string{"$.plans"},
+		},
+		{
+			name:     "sub limit with a fraction and a limit",
+			raw:      `{"default": {"max_requests": 10}, "sub_limit": {"fraction": 0.5, "limit": {"max_requests": 1}}}`,
+			expected: []string{"$.sub_limit"},
+		},
+		{
+			name:     "sub limit without a fraction or a limit",
+			raw:      `{"default": {"max_requests": 10}, "sub_limit": {"key": {"sources": [{"type": "ip"}]}}}`,
+			expected: []string{"$.sub_limit"},
+		},
+		{
+			name:     "invalid sub limit fraction",
+			raw:      `{"default": {"max_requests": 10}, "sub_limit": {"fraction": 1.5}}`,
+			expected: []string{"$.sub_limit.fraction"},
+		},
+		{
+			name:     "invalid sub limit",
+			raw:      `{"default": {"max_requests": 10}, "sub_limit": {"limit": {"max_requests": 0}}}`,
+			expected: []string{"$.sub_limit.limit.max_requests"},
+		},
+		{
+			name:     "jwt without keys",
+			raw:      `{"default": {"max_requests": 10}, "jwt": {"claim": "sub"}}`,
+			expected: []string{"$.jwt"},
+		},
+		{
+			name:     "short jwt secret",
+			raw:      `{"default": {"max_requests": 10}, "jwt": {"secret": "s3cr3t"}}`,
+			expected: []string{"$.jwt.secret"},
+		},
+		{
+			name:     "jwt with a secret and unverified tokens",
+			raw:      `{"default": {"max_requests": 10}, "jwt": {"secret": "s3cr3t", "unverified": true, "claim": 1}}`,
+			expected: []string{"$.jwt", "$.jwt.claim", "$.jwt.secret"},
+		},
+		{
+			name:     "invalid kubernetes node counter",
+			raw:      `{"default": {"max_requests": 10}, "node_counter": {"type": "kubernetes", "fallback": -1, "timeout": "0s"}}`,
+			expected: []string{"$.node_counter", "$.node_counter.fallback", "$.node_counter.timeout"},
+		},
+		{
+			name:     "consul node counter without service",
+			raw:      `{"default": {"max_requests": 10}, "node_counter": {"type": "consul", "address": "http://consul:8500", "tag": 1}}`,
+			expected: []string{"$.node_counter.service", "$.node_counter.tag"},
+		},
+		{
+			name:     "invalid node counter bounds",
+			raw:      `{"default": {"max_requests": 10}, "node_counter": {"min_nodes": 4, "max_nodes": 2, "stable_polls": -1, "stable_for": "-1s", "poll_interval": "10ms"}}`,
+			expected: []string{"$.node_counter.max_nodes", "$.node_counter.poll_interval", "$.node_counter.stable_for", "$.node_counter.stable_polls"},
+		},
+		{
+			name:     "unknown node counter",
+			raw:      `{"default": {"max_requests": 10}, "node_counter": {"type": "zookeeper"}}`,
+			expected: []string{"$.node_counter.type"},
+		},
+		{
+			name:     "redis store without address",
+			raw:      `{"default": {"max_requests": 10}, "store": {"type": "redis"}}`,
+			expected: []string{"$.store.address"},
+		},
+		{
+			name: "impossible values",
+			raw: `{"default": {"max_requests": 0, "burst_size": -1}, "custom": {
+				"kufar.com": {"max_requests": -10, "burst_size": 10000000},
+				"corotos.com": {"burst_size": 5, "period": "48h"},
+				"kufar.by": {"max_requests": 10, "period": "soon"},
+				"other.com": 42,
+				"mixed.com": {"max_requests": 10, "windows": [{"max_requests": 10}]},
+				"empty.com": {"windows": []},
+				"nested.com": {"windows": [{"max_requests": 0}, {"windows": [{"max_requests": 10}]}]}
+			}}`,
+			expected: []string{
+				"$.default.max_requests",
+				"$.default.burst_size",
+				`$.custom["kufar.com"].max_requests`,
+				`$.custom["kufar.com"].burst_size`,
+				`$.custom["corotos.com"].max_requests`,
+				`$.custom["corotos.com"].period`,
+				`$.custom["kufar.by"].period`,
+				`$.custom["other.com"]`,
+				`$.custom["mixed.com"].max_requests`,
+				`$.custom["empty.com"].windows`,
+				`$.custom["nested.com"].windows[0].max_requests`,
+				`$.custom["nested.com"].windows[1].windows`,
+			},
+		},
+	}
+
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			extra := parseExtraConfig(t, `{"github.com/schibsted/krakend-ratelimit": `+c.raw+`}`)
+			_, err := ParseConfig(extra)
+			verr, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("Unexpected error type (expected: ValidationError, got: %T)", err)
+			}
+			got := make([]string, len(verr))
+			for i, fe := range verr {
+				got[i] = fe.Path
+			}
+			sort.Strings(got)
+			sort.Strings(c.expected)
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Unexpected invalid fields (expected: %v, got: %v)", c.expected, got)
+			}
+			if ConfigGetter(extra) != nil {
+				t.Errorf("ConfigGetter should not return an invalid config")
+			}
+		})
+	}
+}
+
+func TestParseConfigErrorsOrder(t *testing.T) {
+	extra := parseExtraConfig(t, `{"github.com/schibsted/krakend-ratelimit": {"default": {"max_requests": 10},
+		"node_counter": {"stable_polls": -1, "min_nodes": -1, "max_nodes": -1},
+		"custom": {"kufar.com": {"max_requests": 0}, "corotos.com": {"max_requests": 0}, "avito.ru": 1},
+		"client_ip": {"ipv4_prefix": 64, "ipv6_prefix": 256, "groups": {"office": ["x"], "vpn": ["y"]}}}}`)
+	expected := ""
+	for i := 0; i < 20; i++ {
+		_, err := ParseConfig(extra)
+		if err == nil {
+			t.Fatalf("An error is expected")
+		}
+		if i == 0 {
+			expected = err.Error()
+			continue
+		}
+		if err.Error() != expected {
+			t.Fatalf("Unexpected error (expected: %s, got: %s)", expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+const defaultConsulAddress = "http://127.0.0.1:8500"
+
+// Node counter for consul. It counts the instances of cfg.Service (with cfg.Tag, if set)
+// passing all their health checks, using the health API of the cfg.Address agent
+func NewConsulNodeCounter(client *http.Client, cfg NodeCounterConfig, logger logging.Logger) NodeCounter {
+	return newConsulNodes(client, cfg, logger).Count
+}
+
+// Instance of a service in the consul health API response
+type consulServiceEntry struct {
+	Node struct {
+		Node string
+	}
+	Service struct {
+		ID string
+	}
+}
+
+// The nodes are identified by their consul node name and service id (e.g. node1/krakend). The
+// running node is <hostname>/<service> by default
+func newConsulNodes(client *http.Client, cfg NodeCounterConfig, logger logging.Logger) *lastKnownNodes {
+	address := cfg.Address
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	query := url.Values{"passing": {"true"}}
+	if cfg.Tag != "" {
+		query.Set("tag", cfg.Tag)
+	}
+	u := strings.TrimSuffix(address, "/") + "/v1/health/service/" + url.PathEscape(cfg.Service) + "?" + query.Encode()
+	timeout := nodeCounterTimeout(cfg)
+
+	return newLastKnownNodes(ConsulNodeCounter, cfg, hostname()+"/"+cfg.Service, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected consul response status %d", resp.StatusCode)
+		}
+		var entries []consulServiceEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return nil, err
+		}
+		ids := map[string]struct{}{}
+		for _, e := range entries {
+			ids[e.Node.Node+"/"+e.Service.ID] = struct{}{}
+		}
+		return setKeys(ids), nil
+	}, logger)
+}
@@ -0,0 +1,71 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestConsulNodeCounter(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/krakend" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("passing") != "true" {
+			t.Errorf("Only the passing instances must be requested: %s", r.URL.RawQuery)
+		}
+		if s := int(atomic.LoadInt32(&status)); s != http.StatusOK {
+			w.WriteHeader(s)
+			return
+		}
+		if r.URL.Query().Get("tag") == "eu" {
+			w.Write([]byte(`[{"Service": {"ID": "krakend-1"}}]`))
+			return
+		}
+		w.Write([]byte(`[{"Service": {"ID": "krakend-1"}}, {"Service": {"ID": "krakend-2"}}]`))
+	}))
+	defer server.Close()
+
+	nodeCounter := NewConsulNodeCounter(server.Client(), NodeCounterConfig{Address: server.URL, Service: "krakend"}, logger)
+	if n := nodeCounter(); n != 2 {
+		t.Errorf("Unexpected node count (expected: 2, got: %d)", n)
+	}
+
+	tagged := NewConsulNodeCounter(server.Client(), NodeCounterConfig{Address: server.URL + "/", Service: "krakend", Tag: "eu"}, logger)
+	if n := tagged(); n != 1 {
+		t.Errorf("Unexpected tagged node count (expected: 1, got: %d)", n)
+	}
+
+	// the agent fails: the last known count is kept
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if n := nodeCounter(); n != 2 {
+		t.Errorf("Unexpected last known node count (expected: 2, got: %d)", n)
+	}
+}
+
+func TestConsulNodeCounterTimeout(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	cfg := NodeCounterConfig{Address: server.URL, Service: "krakend", Fallback: 3, Timeout: 10 * time.Millisecond}
+	nodeCounter := NewConsulNodeCounter(server.Client(), cfg, logger)
+	if n := nodeCounter(); n != 3 {
+		t.Errorf("Unexpected fallback node count (expected: 3, got: %d)", n)
+	}
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+// Node counter for DNS SRV records. It counts the distinct targets of the cfg.Service
+// record (e.g. _krakend._tcp.example.com), resolved with the cfg.Address DNS server
+func NewDNSNodeCounter(cfg NodeCounterConfig, logger logging.Logger) NodeCounter {
+	return newDNSNodes(cfg, logger).Count
+}
+
+// The nodes are identified by their target and port (e.g. node1.example.com:8080)
+func newDNSNodes(cfg NodeCounterConfig, logger logging.Logger) *lastKnownNodes {
+	resolver := net.DefaultResolver
+	if cfg.Address != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, cfg.Address)
+			},
+		}
+	}
+	timeout := nodeCounterTimeout(cfg)
+
+	return newLastKnownNodes(DNSNodeCounter, cfg, hostname(), func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", cfg.Service)
+		if err != nil {
+			return nil, err
+		}
+		targets := map[string]struct{}{}
+		for _, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			targets[net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))] = struct{}{}
+		}
+		return setKeys(targets), nil
+	}, logger)
+}
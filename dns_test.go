@@ -0,0 +1,97 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNSServer answers the SRV queries for name with the current targets. When
+// targets is empty, the name does not exist
+func startDNSServer(t *testing.T, name string, targets *atomic.Value) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to start the DNS server: %s", err.Error())
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			srvs := targets.Load().([]string)
+			rcode := dnsmessage.RCodeSuccess
+			if q.Name.String() != name || q.Type != dnsmessage.TypeSRV || len(srvs) == 0 {
+				rcode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: rcode})
+			b.EnableCompression()
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if rcode == dnsmessage.RCodeSuccess {
+				for _, target := range srvs {
+					b.SRVResource(
+						dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 60},
+						dnsmessage.SRVResource{Priority: 1, Weight: 1, Port: 8080, Target: dnsmessage.MustNewName(target)},
+					)
+				}
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestDNSNodeCounter(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	var targets atomic.Value
+	targets.Store([]string{"node1.example.com.", "node2.example.com.", "node3.example.com.", "node1.example.com."})
+	address, stop := startDNSServer(t, "_krakend._tcp.example.com.", &targets)
+	defer stop()
+
+	nodeCounter := NewDNSNodeCounter(NodeCounterConfig{Address: address, Service: "_krakend._tcp.example.com", Fallback: 5}, logger)
+	if n := nodeCounter(); n != 3 {
+		t.Errorf("Unexpected node count (expected: 3, got: %d)", n)
+	}
+
+	targets.Store([]string{"node1.example.com."})
+	if n := nodeCounter(); n != 1 {
+		t.Errorf("Unexpected node count (expected: 1, got: %d)", n)
+	}
+
+	// the record disappears: the last known count is kept
+	targets.Store([]string{})
+	if n := nodeCounter(); n != 1 {
+		t.Errorf("Unexpected last known node count (expected: 1, got: %d)", n)
+	}
+
+	// unknown record before the first successful count: the fallback is used
+	nodeCounter = NewDNSNodeCounter(NodeCounterConfig{Address: address, Service: "_other._tcp.example.com", Fallback: 5}, logger)
+	if n := nodeCounter(); n != 5 {
+		t.Errorf("Unexpected fallback node count (expected: 5, got: %d)", n)
+	}
+}
@@ -0,0 +1,206 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/devopsfaith/krakend/logging"
+)
+
+// Environment variable with the task metadata endpoint (v4) set by the ECS agent
+const ecsMetadataURIEnv = "ECS_CONTAINER_METADATA_URI_V4"
+
+// DescribeTasks accepts up to 100 tasks per request
+const ecsDescribeTasksLimit = 100
+
+// Node counter for amazon ECS. It counts the RUNNING tasks of cfg.Service in cfg.Cluster. If they
+// are not set, the cluster and service of the running task are used. Tasks not started by a
+// service are counted with the other RUNNING tasks of the same family
+func NewEcsNodeCounter(ECS *ECS, task *ECSTaskMetadata, cfg NodeCounterConfig, logger logging.Logger) NodeCounter {
+	return newEcsNodes(ECS, task, cfg, logger).Count
+}
+
+// The nodes are identified by their task ARN. The tasks are listed instead of reading the
+// running count of the service, so the index of the running task is known
+func newEcsNodes(ECS *ECS, task *ECSTaskMetadata, cfg NodeCounterConfig, logger logging.Logger) *lastKnownNodes {
+	group := newEcsTaskGroup(ECS, task, cfg)
+	return newLastKnownNodes(EcsNodeCounter, cfg, task.TaskARN, func() ([]string, error) {
+		cluster, g, err := group()
+		if err != nil {
+			return nil, err
+		}
+		if service := strings.TrimPrefix(g, "service:"); service != g {
+			return ECS.ListServiceTasks(cluster, service)
+		}
+		return ECS.ListFamilyTasks(cluster, strings.TrimPrefix(g, "family:"))
+	}, logger)
+}
+
+// newEcsTaskGroup returns the cluster and the group of the counted tasks (service:<name> or
+// family:<name>). The group of a task never changes, so it is only described once
+func newEcsTaskGroup(ECS *ECS, task *ECSTaskMetadata, cfg NodeCounterConfig) func() (string, string, error) {
+	cluster := cfg.Cluster
+	if cluster == "" {
+		cluster = task.Cluster
+	}
+	group := ""
+	if cfg.Service != "" {
+		group = "service:" + cfg.Service
+	}
+	return func() (string, string, error) {
+		if group == "" {
+			g, err := ECS.GetTaskGroup(cluster, task.TaskARN)
+			if err != nil {
+				return "", "", err
+			}
+			group = g
+		}
+		return cluster, group, nil
+	}
+}
+
+// Build the ecs nodes for the running task
+func newEcsNodesFromMetadata(cfg NodeCounterConfig, logger logging.Logger) (*lastKnownNodes, error) {
+	ECS, task, err := newECSFromMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return newEcsNodes(ECS, task, cfg, logger), nil
+}
+
+// Read the running task metadata and build an ECS client for the region of its cluster
+func newECSFromMetadata() (*ECS, *ECSTaskMetadata, error) {
+	task, err := NewECSMetadata().GetTaskMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	clusterArn, err := arn.Parse(task.Cluster)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unexpected cluster ARN %s: %s", task.Cluster, err.Error())
+	}
+	sess := NewAwsSessionWithRegion(clusterArn.Region)
+	return NewECS(sess), &task, nil
+}
+
+// ECSTaskMetadata is the part of the task metadata used to find the service of the task
+type ECSTaskMetadata struct {
+	Cluster string `json:"Cluster"`
+	TaskARN string `json:"TaskARN"`
+	Family  string `json:"Family"`
+}
+
+func NewECSMetadata() *ECSMetadata {
+	return &ECSMetadata{Client: &http.Client{}, Endpoint: os.Getenv(ecsMetadataURIEnv)}
+}
+
+type ECSMetadata struct {
+	Client   *http.Client
+	Endpoint string
+}
+
+func (r *ECSMetadata) GetTaskMetadata() (ECSTaskMetadata, error) {
+	task := ECSTaskMetadata{}
+	if r.Endpoint == "" {
+		return task, fmt.Errorf("Task metadata endpoint not found (%s is not set)", ecsMetadataURIEnv)
+	}
+	resp, err := r.Client.Get(strings.TrimSuffix(r.Endpoint, "/") + "/task")
+	if err != nil {
+		return task, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return task, fmt.Errorf("Unexpected task metadata response status %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	return task, err
+}
+
+func NewECS(sess *session.Session) *ECS {
+	return &ECS{Client: ecs.New(sess)}
+}
+
+type ECS struct {
+	Client ecsiface.ECSAPI
+}
+
+func (c *ECS) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	return c.Client.DescribeTasks(input)
+}
+
+func (c *ECS) ListTasksPages(input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool) error {
+	return c.Client.ListTasksPages(input, fn)
+}
+
+// GetTaskGroup returns the group of the task: service:<name> or family:<name>
+func (c *ECS) GetTaskGroup(cluster, taskArn string) (string, error) {
+	tasks, err := c.DescribeTasks(&ecs.DescribeTasksInput{Cluster: aws.String(cluster), Tasks: []*string{aws.String(taskArn)}})
+	if err != nil {
+		return "", err
+	}
+	if len(tasks.Tasks) == 0 || tasks.Tasks[0].Group == nil {
+		return "", fmt.Errorf("Task %s not found", taskArn)
+	}
+	return *tasks.Tasks[0].Group, nil
+}
+
+// ListServiceTasks returns the ARNs of the RUNNING tasks of the service
+func (c *ECS) ListServiceTasks(cluster, service string) ([]string, error) {
+	return c.listRunningTasks(&ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	})
+}
+
+// ListFamilyTasks returns the ARNs of the RUNNING tasks of the family
+func (c *ECS) ListFamilyTasks(cluster, family string) ([]string, error) {
+	return c.listRunningTasks(&ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		Family:        aws.String(family),
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	})
+}
+
+// Listed tasks may still be pending, so their last status is checked
+func (c *ECS) listRunningTasks(input *ecs.ListTasksInput) ([]string, error) {
+	var arns []*string
+	err := c.ListTasksPages(input, func(page *ecs.ListTasksOutput, _ bool) bool {
+		arns = append(arns, page.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	running := []string{}
+	for len(arns) > 0 {
+		batch := arns
+		if len(batch) > ecsDescribeTasksLimit {
+			batch = batch[:ecsDescribeTasksLimit]
+		}
+		arns = arns[len(batch):]
+		tasks, err := c.DescribeTasks(&ecs.DescribeTasksInput{Cluster: input.Cluster, Tasks: batch})
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks.Tasks {
+			if aws.StringValue(task.LastStatus) == ecs.DesiredStatusRunning {
+				running = append(running, aws.StringValue(task.TaskArn))
+			}
+		}
+	}
+	return running, nil
+}
@@ -0,0 +1,230 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/devopsfaith/krakend/logging"
+)
+
+type ECSMock struct {
+	ecsiface.ECSAPI
+	groups     map[string]string
+	services   map[string][]string
+	pages      [][]string
+	lastStatus map[string]string
+	calls      map[string]int
+}
+
+func (c *ECSMock) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	c.calls["DescribeTasks"]++
+	if aws.StringValue(input.Cluster) != "krakend" {
+		return nil, fmt.Errorf("Error")
+	}
+	out := &ecs.DescribeTasksOutput{}
+	for _, arn := range input.Tasks {
+		task := &ecs.Task{TaskArn: arn}
+		if g, ok := c.groups[*arn]; ok {
+			task.Group = aws.String(g)
+		}
+		if s, ok := c.lastStatus[*arn]; ok {
+			task.LastStatus = aws.String(s)
+		}
+		out.Tasks = append(out.Tasks, task)
+	}
+	return out, nil
+}
+
+func (c *ECSMock) ListTasksPages(input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool) error {
+	c.calls["ListTasks"]++
+	if aws.StringValue(input.DesiredStatus) != ecs.DesiredStatusRunning {
+		return fmt.Errorf("Unexpected input %v", input)
+	}
+	pages := c.pages
+	if input.ServiceName != nil {
+		tasks, ok := c.services[*input.ServiceName]
+		if !ok {
+			return fmt.Errorf("Service %s not found", *input.ServiceName)
+		}
+		pages = [][]string{tasks}
+	} else if aws.StringValue(input.Family) != "krakend-task" {
+		return fmt.Errorf("Unexpected input %v", input)
+	}
+	for i, page := range pages {
+		if !fn(&ecs.ListTasksOutput{TaskArns: aws.StringSlice(page)}, i == len(c.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestNewEcsNodeCounterService(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	mock := &ECSMock{
+		groups: map[string]string{"task-1": "service:krakend-svc"},
+		services: map[string][]string{
+			"krakend-svc": {"task-1", "task-2", "task-3", "task-4"},
+			"other-svc":   {"task-5", "task-6"},
+		},
+		lastStatus: map[string]string{
+			"task-1": "RUNNING", "task-2": "RUNNING", "task-3": "RUNNING", "task-4": "RUNNING",
+			"task-5": "RUNNING", "task-6": "RUNNING",
+		},
+		calls: map[string]int{},
+	}
+	task := &ECSTaskMetadata{Cluster: "krakend", TaskARN: "task-1"}
+
+	nodeCounter := NewEcsNodeCounter(&ECS{Client: mock}, task, NodeCounterConfig{}, logger)
+	for i := 0; i < 3; i++ {
+		if n := nodeCounter(); n != 4 {
+			t.Errorf("Unexpected node count (expected: 4, got: %d)", n)
+		}
+	}
+	if mock.calls["ListTasks"] != 3 {
+		t.Errorf("Unexpected ListTasks calls (expected: 3, got: %d)", mock.calls["ListTasks"])
+	}
+
+	nodeCounter = NewEcsNodeCounter(&ECS{Client: mock}, task, NodeCounterConfig{Service: "other-svc"}, logger)
+	if n := nodeCounter(); n != 2 {
+		t.Errorf("Unexpected node count for the configured service (expected: 2, got: %d)", n)
+	}
+
+	nodeCounter = NewEcsNodeCounter(&ECS{Client: mock}, task, NodeCounterConfig{Service: "unknown-svc", Fallback: 3}, logger)
+	if n := nodeCounter(); n != 3 {
+		t.Errorf("Unexpected fallback node count (expected: 3, got: %d)", n)
+	}
+
+	nodeCounter = NewEcsNodeCounter(&ECS{Client: mock}, task, NodeCounterConfig{Cluster: "other", Fallback: 2}, logger)
+	if n := nodeCounter(); n != 2 {
+		t.Errorf("Unexpected fallback node count (expected: 2, got: %d)", n)
+	}
+}
+
+func TestEcsNodesService(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	mock := &ECSMock{
+		groups: map[string]string{"task-3": "service:krakend-svc"},
+		services: map[string][]string{
+			"krakend-svc": {"task-1", "task-2", "task-3", "task-4", "task-5"},
+		},
+		lastStatus: map[string]string{
+			"task-1": "RUNNING", "task-2": "RUNNING", "task-3": "RUNNING", "task-4": "RUNNING", "task-5": "STOPPED",
+		},
+		calls: map[string]int{},
+	}
+	task := &ECSTaskMetadata{Cluster: "krakend", TaskARN: "task-3"}
+
+	nodes := newEcsNodes(&ECS{Client: mock}, task, NodeCounterConfig{}, logger)
+	for i := 0; i < 3; i++ {
+		if n := nodes.Count(); n != 4 {
+			t.Errorf("Unexpected node count (expected: 4, got: %d)", n)
+		}
+	}
+	// one call for the task group and one per count
+	if mock.calls["DescribeTasks"] != 4 {
+		t.Errorf("The task group should be cached (DescribeTasks calls: %d)", mock.calls["DescribeTasks"])
+	}
+	if i := nodes.Index(4); i != 2 {
+		t.Errorf("Unexpected task index (expected: 2, got: %d)", i)
+	}
+
+	nodes = newEcsNodes(&ECS{Client: mock}, task, NodeCounterConfig{Service: "unknown-svc", Fallback: 3}, logger)
+	if n := nodes.Count(); n != 3 {
+		t.Errorf("Unexpected fallback node count (expected: 3, got: %d)", n)
+	}
+	if i := nodes.Index(3); i != -1 {
+		t.Errorf("Unexpected task index of the fallback count (expected: -1, got: %d)", i)
+	}
+}
+
+func TestNewEcsNodeCounterFamily(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	mock := &ECSMock{
+		groups:     map[string]string{"task-1": "family:krakend-task"},
+		lastStatus: map[string]string{},
+		calls:      map[string]int{},
+	}
+	// 150 listed tasks in two pages, 120 of them running
+	for p := 0; p < 2; p++ {
+		page := []string{}
+		for i := 0; i < 75; i++ {
+			arn := fmt.Sprintf("task-%d-%d", p, i)
+			page = append(page, arn)
+			mock.lastStatus[arn] = "RUNNING"
+			if i < 15 {
+				mock.lastStatus[arn] = "PENDING"
+			}
+		}
+		mock.pages = append(mock.pages, page)
+	}
+
+	task := &ECSTaskMetadata{Cluster: "krakend", TaskARN: "task-1", Family: "krakend-task"}
+	nodeCounter := NewEcsNodeCounter(&ECS{Client: mock}, task, NodeCounterConfig{}, logger)
+	if n := nodeCounter(); n != 120 {
+		t.Errorf("Unexpected node count (expected: 120, got: %d)", n)
+	}
+	// one call for the task group and two batches of tasks
+	if mock.calls["DescribeTasks"] != 3 {
+		t.Errorf("Unexpected DescribeTasks calls (expected: 3, got: %d)", mock.calls["DescribeTasks"])
+	}
+}
+
+func TestECSMetadata_GetTaskMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/container-id/task" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+			"Cluster": "arn:aws:ecs:eu-west-1:111122223333:cluster/krakend",
+			"TaskARN": "arn:aws:ecs:eu-west-1:111122223333:task/krakend/0123456789",
+			"Family": "krakend-task",
+			"Revision": "3"
+		}`))
+	}))
+	defer server.Close()
+
+	checks := []struct {
+		endpoint    string
+		expected    ECSTaskMetadata
+		expectedErr bool
+	}{
+		{
+			endpoint: server.URL + "/v4/container-id",
+			expected: ECSTaskMetadata{
+				Cluster: "arn:aws:ecs:eu-west-1:111122223333:cluster/krakend",
+				TaskARN: "arn:aws:ecs:eu-west-1:111122223333:task/krakend/0123456789",
+				Family:  "krakend-task",
+			},
+		},
+		{endpoint: server.URL + "/v3/container-id", expectedErr: true},
+		{endpoint: "", expectedErr: true},
+	}
+
+	for _, c := range checks {
+		metadata := &ECSMetadata{Client: server.Client(), Endpoint: c.endpoint}
+		got, err := metadata.GetTaskMetadata()
+		if c.expectedErr {
+			if err == nil {
+				t.Errorf("An error is expected for endpoint %q", c.endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("An error is not expected %s", err.Error())
+		}
+		if got != c.expected {
+			t.Errorf("Unexpected task metadata (expected: %+v, got: %+v)", c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	kgin "github.com/devopsfaith/krakend/router/gin"
+)
+
+// EndpointHandlerFactory wraps a kgin.HandlerFactory (e.g. kgin.EndpointHandler) so every
+// endpoint declaring the Namespace block in its extra_config gets a dedicated rate limiter.
+// Endpoint settings inherit the service level defaults and custom tenants (see ParseEndpointConfig).
+// The updaters of the rate limiters stop when ctx is done, so cancel it when the router is rebuilt.
+// An invalid endpoint config is fatal, so a misconfigured endpoint never runs without its limits
+func EndpointHandlerFactory(ctx context.Context, next kgin.HandlerFactory, serviceCfg RateLimitConfig, nodeCounter NodeCounter,
+	varyBy VaryByFunc, logger logging.Logger) kgin.HandlerFactory {
+	return func(endpointCfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(endpointCfg, p)
+
+		ginRateLimiter, err := newEndpointRateLimiter(ctx, endpointCfg, serviceCfg, nodeCounter, varyBy, logger)
+		if err != nil {
+			logger.Fatal("Unable to build RateLimit for endpoint", endpointCfg.Endpoint, ":", err.Error())
+		}
+		if ginRateLimiter == nil {
+			return handler
+		}
+		logger.Info("Starting endpoint RateLimit for", endpointCfg.Endpoint)
+
+		middleware := ginRateLimiter.RateLimit()
+		return func(c *gin.Context) {
+			middleware(c)
+			if c.IsAborted() {
+				return
+			}
+			handler(c)
+		}
+	}
+}
+
+// newEndpointRateLimiter returns a nil GinRateLimiter if the endpoint has no config or it is disabled
+func newEndpointRateLimiter(ctx context.Context, endpointCfg *config.EndpointConfig, serviceCfg RateLimitConfig, nodeCounter NodeCounter,
+	varyBy VaryByFunc, logger logging.Logger) (*GinRateLimiter, error) {
+	cfg, err := ParseEndpointConfig(serviceCfg, endpointCfg.ExtraConfig)
+	if err == ErrNoConfig {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	// keep the endpoint buckets apart from the service ones in shared stores
+	cfg.Store.KeyPrefix += endpointCfg.Method + endpointCfg.Endpoint + ":"
+
+	rateLimiter, _, err := GinRateLimitWithContext(ctx, cfg, nodeCounter, nil, logger, UpdaterHooks{})
+	if err != nil {
+		return nil, err
+	}
+	return NewGinRateLimiter(rateLimiter, varyBy, cfg, logger)
+}
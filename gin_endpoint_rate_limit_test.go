@@ -0,0 +1,150 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseEndpointConfig(t *testing.T) {
+	service := RateLimitConfig{
+		Enabled: true,
+		Default: RateLimitSettings{MaxRequests: 600, BurstSize: 5},
+		Custom: map[string]RateLimitSettings{
+			"kufar.com":   {MaxRequests: 60, BurstSize: 10},
+			"corotos.com": {MaxRequests: 40, BurstSize: 5},
+		},
+	}
+	extra := parseExtraConfig(t, `{
+		"github.com/schibsted/krakend-ratelimit": {
+			"custom": {"kufar.com": {"max_requests": 6, "burst_size": 1}}
+		}
+	}`)
+
+	cfg, err := ParseEndpointConfig(service, extra)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !cfg.Enabled {
+		t.Errorf("Endpoint config should inherit enabled flag")
+	}
+	if !reflect.DeepEqual(cfg.Default, service.Default) {
+		t.Errorf("Unexpected default settings (expected: %+v, got: %+v)", service.Default, cfg.Default)
+	}
+	if s := cfg.Custom["kufar.com"]; s.MaxRequests != 6 || s.BurstSize != 1 {
+		t.Errorf("Unexpected overridden tenant settings: %+v", s)
+	}
+	if s := cfg.Custom["corotos.com"]; !reflect.DeepEqual(s, service.Custom["corotos.com"]) {
+		t.Errorf("Unexpected inherited tenant settings: %+v", s)
+	}
+	if s := service.Custom["kufar.com"]; s.MaxRequests != 60 {
+		t.Errorf("Service config should not be modified: %+v", s)
+	}
+
+	if _, err := ParseEndpointConfig(service, config.ExtraConfig{}); err != ErrNoConfig {
+		t.Errorf("Unexpected error (expected: %v, got: %v)", ErrNoConfig, err)
+	}
+}
+
+func TestEndpointHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger, _ := logging.NewLogger("ERROR", os.Stdout, "[KRAKEND]")
+
+	service := RateLimitConfig{
+		Enabled: true,
+		Default: RateLimitSettings{MaxRequests: 6000, BurstSize: 100},
+	}
+	next := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		}
+	}
+	factory := EndpointHandlerFactory(context.Background(), next, service, DefaultNodeCounter(), ContextKeyVaryBy("SiteKey"), logger)
+
+	limited := &config.EndpointConfig{
+		Endpoint: "/checkout",
+		ExtraConfig: parseExtraConfig(t, `{
+			"github.com/schibsted/krakend-ratelimit": {"default": {"max_requests": 1, "burst_size": 0}}
+		}`),
+	}
+	disabled := &config.EndpointConfig{
+		Endpoint: "/disabled",
+		ExtraConfig: parseExtraConfig(t, `{
+			"github.com/schibsted/krakend-ratelimit": {"enabled": false, "default": {"max_requests": 1}}
+		}`),
+	}
+	unlimited := &config.EndpointConfig{Endpoint: "/search"}
+
+	engine := gin.New()
+	engine.GET(limited.Endpoint, factory(limited, nil))
+	engine.GET(disabled.Endpoint, factory(disabled, nil))
+	engine.GET(unlimited.Endpoint, factory(unlimited, nil))
+
+	checks := []struct {
+		path     string
+		expected []int
+	}{
+		{path: "/checkout", expected: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{path: "/disabled", expected: []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{path: "/search", expected: []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+	}
+
+	for _, c := range checks {
+		for i, status := range c.expected {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", c.path, nil)
+			engine.ServeHTTP(w, req)
+			if w.Code != status {
+				t.Errorf("Unexpected status for request %d to %s (expected: %d, got: %d)", i, c.path, status, w.Code)
+			}
+		}
+	}
+}
+
+// fatalLogger panics instead of exiting on Fatal, so the tests can check the fatal errors
+type fatalLogger struct {
+	logging.Logger
+}
+
+func (l fatalLogger) Fatal(v ...interface{}) {
+	panic(fmt.Sprint(v...))
+}
+
+func assertFatal(t *testing.T, name string, f func()) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s should be fatal", name)
+		}
+	}()
+	f()
+}
+
+func TestEndpointHandlerFactoryInvalidConfig(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	service := RateLimitConfig{Enabled: true, Default: RateLimitSettings{MaxRequests: 6000, BurstSize: 100}}
+	next := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {}
+	}
+	factory := EndpointHandlerFactory(context.Background(), next, service, DefaultNodeCounter(), nil, fatalLogger{logger})
+
+	for _, raw := range []string{
+		`{"github.com/schibsted/krakend-ratelimit": {"default": {"max_requests": "many"}}}`,
+		`{"github.com/schibsted/krakend-ratelimit": {"key": {"sources": [{"type": "claim", "name": "sub"}]}}}`,
+	} {
+		endpointCfg := &config.EndpointConfig{Endpoint: "/checkout", ExtraConfig: parseExtraConfig(t, raw)}
+		assertFatal(t, raw, func() { factory(endpointCfg, nil) })
+	}
+}
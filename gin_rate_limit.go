@@ -6,10 +6,10 @@
 package ratelimit
 
 import (
+	"context"
 	"errors"
 
 	"github.com/gin-gonic/gin"
-	"github.com/tomasen/realip"
 
 	"github.com/throttled/throttled"
 
@@ -19,42 +19,21 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 // Namespace is the key to look for extra configuration details
 const Namespace = "github.com/schibsted/krakend-ratelimit"
 
-// ConfigGetter implements the config.ConfigGetter interface
+// ConfigGetter implements the config.ConfigGetter interface. It returns nil
+// if the Namespace block is missing or invalid; use ParseConfig to get the
+// validation errors
 func ConfigGetter(e config.ExtraConfig) interface{} {
-	v, ok := e[Namespace]
-	if !ok {
+	cfg, err := ParseConfig(e)
+	if err != nil {
 		return nil
 	}
-	tmp, ok := v.(map[string]interface{})
-	if !ok {
-		return nil
-	}
-	cfg := RateLimitConfig{}
-	if val, ok := tmp["enabled"]; ok {
-		cfg.Enabled = val.(bool)
-	}
-
-	if val, ok := tmp["default"]; ok {
-		defaults, ok := val.(map[string]interface{})
-		if !ok {
-			return nil
-		}
-		settings := RateLimitSettings{}
-		if val, ok := defaults["max_requests"]; ok {
-			settings.MaxRequests = int(val.(float64))
-		}
-		if val, ok := defaults["burst_size"]; ok {
-			settings.BurstSize = int(val.(float64))
-		}
-		cfg.Default = settings
-	}
-
 	return cfg
 }
 
@@ -63,10 +42,19 @@ var (
 )
 
 func GinRateLimit(cfg RateLimitConfig, nodeCounter NodeCounter, logger logging.Logger) (UpdatableClusterRateLimiter, error) {
-	rateLimiter := BuildRateLimiter(cfg, nodeCounter, logger)
-	go RateLimitUpdater(rateLimiter, rateLimiterUpdateRate, nodeCounter, logger)
+	rateLimiter, _, err := GinRateLimitWithContext(context.Background(), cfg, nodeCounter, nil, logger, UpdaterHooks{})
+	return rateLimiter, err
+}
 
-	return rateLimiter, nil
+// GinRateLimitWithContext works like GinRateLimit, but the returned Updater stops when ctx is done,
+// so config reloads and tests do not leak the updater goroutine. nodeIndex is only required by the
+// exact split and can be nil
+func GinRateLimitWithContext(ctx context.Context, cfg RateLimitConfig, nodeCounter NodeCounter, nodeIndex NodeIndex,
+	logger logging.Logger, hooks UpdaterHooks) (UpdatableClusterRateLimiter, *Updater, error) {
+	rateLimiter := BuildIndexedRateLimiter(cfg, nodeCounter, nodeIndex, logger)
+	updater := StartUpdater(ctx, rateLimiter, updateInterval(cfg.UpdateInterval), nodeCounter, logger, hooks)
+
+	return rateLimiter, updater, nil
 }
 
 // Build context key based rate limiter (e.g. we can store the issuer/tenant as a context param)
@@ -78,30 +66,64 @@ func GinContextRateLimit(rateLimiter throttled.RateLimiter, contextKey string) *
 	}
 }
 
-// Build IP based rate limiter
+// Build IP based rate limiter. The IP stored in the context under contextKey (if any) is used
+// instead of the request one (e.g. an IP previously resolved with a ClientIPResolver). The
+// forwarding headers are ignored, so the request IP is the remote address. Behind proxies, use
+// GinIpRateLimitWithConfig instead
 func GinIpRateLimit(rateLimiter throttled.RateLimiter, contextKey string) *GinRateLimiter {
 	return &GinRateLimiter{
 		RateLimiter: rateLimiter,
-		VaryBy:      getRequestIp,
+		VaryBy:      readContextIp(contextKey, defaultClientIPResolver),
 	}
 }
 
+// GinIpRateLimitWithConfig works like GinIpRateLimit, with the request IP found by the
+// ClientIPResolver of cfg, so the forwarding headers of the trusted proxies are read
+func GinIpRateLimitWithConfig(rateLimiter throttled.RateLimiter, contextKey string, cfg ClientIPConfig) (*GinRateLimiter, error) {
+	resolver, err := NewClientIPResolver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &GinRateLimiter{
+		RateLimiter: rateLimiter,
+		VaryBy:      readContextIp(contextKey, resolver),
+	}, nil
+}
+
 type VaryByFunc func(*gin.Context) string
 
+// ContextKeyVaryBy returns a VaryByFunc using the value stored in the gin context under contextKey
+func ContextKeyVaryBy(contextKey string) VaryByFunc {
+	return readContextKey(contextKey)
+}
+
+// IpVaryBy returns a VaryByFunc using the remote address of the request. Behind proxies, use
+// the VaryBy of a ClientIPResolver with the trusted ones
+func IpVaryBy() VaryByFunc {
+	return defaultClientIPResolver.VaryBy()
+}
+
 // Use site-key stored in context (and previously extracted from JWT token
 func readContextKey(contextKey string) VaryByFunc {
 	return func(c *gin.Context) string {
 		value, found := c.Get(contextKey)
-		if !found {
+		if !found || value == nil {
 			return "unknown"
 		} else {
-			return value.(string)
+			return contextValue(value)
 		}
 	}
 }
 
-func getRequestIp(c *gin.Context) string {
-	return realip.RealIP(c.Request)
+func readContextIp(contextKey string, resolver *ClientIPResolver) VaryByFunc {
+	return func(c *gin.Context) string {
+		if value, found := c.Get(contextKey); found && contextKey != "" {
+			if ip, ok := value.(string); ok && ip != "" {
+				return ip
+			}
+		}
+		return resolver.Key(c.Request)
+	}
 }
 
 var (
@@ -109,28 +131,111 @@ var (
 	// HTTPRateLimiter. It returns a 429 status code with a generic
 	// message.
 	DefaultDeniedHandler = func(c *gin.Context) {
-		c.JSON(http.StatusTooManyRequests, "limit exceeded")
-		c.AbortWithStatus(http.StatusTooManyRequests)
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, "limit exceeded")
 	}
 
 	// DefaultError is the default Error function for an HTTPRateLimiter.
 	// It returns a 500 status code with a generic message.
 	DefaultError = func(c *gin.Context, err error) {
-		c.JSON(http.StatusInternalServerError, "internal error")
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, "internal error")
 	}
 )
 
+// NewGinRateLimiter builds a GinRateLimiter with the headers and the responses of the config.
+// If the config has key sources, they are used instead of varyBy (see NewKeyBuilder). If it
+// only has a JWT config, the requests are keyed on its claim. The sub limit key defaults to
+// the client IP. The failures of the RateLimiter are logged with logger
+func NewGinRateLimiter(rateLimiter throttled.RateLimiter, varyBy VaryByFunc, cfg RateLimitConfig, logger logging.Logger) (*GinRateLimiter, error) {
+	var keyFunc KeyFunc
+	var verifier *JWTVerifier
+	if cfg.JWT.enabled() {
+		var err error
+		if verifier, err = NewJWTVerifier(cfg.JWT); err != nil {
+			return nil, err
+		}
+		if len(cfg.Key.Sources) == 0 {
+			cfg.Key.Sources = []KeySource{{Type: ClaimKeySource, Name: verifier.claim}}
+		}
+	}
+	var resolver *ClientIPResolver
+	if len(cfg.Key.Sources) > 0 || cfg.SubLimit.enabled() {
+		var err error
+		if resolver, err = NewClientIPResolver(cfg.ClientIP); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Key.Sources) > 0 {
+		keyBuilder, err := NewKeyBuilder(cfg.Key, resolver, verifier)
+		if err != nil {
+			return nil, err
+		}
+		keyFunc = keyBuilder.Key
+	}
+	var subKeyFunc KeyFunc
+	if cfg.SubLimit.enabled() {
+		subKey := cfg.SubLimit.Key
+		if len(subKey.Sources) == 0 {
+			subKey.Sources = []KeySource{{Type: IPKeySource}}
+		}
+		keyBuilder, err := NewKeyBuilder(subKey, resolver, verifier)
+		if err != nil {
+			return nil, err
+		}
+		subKeyFunc = keyBuilder.Key
+	}
+	denied, err := NewDeniedResponse(cfg.Denied)
+	if err != nil {
+		return nil, err
+	}
+	errorResponse, err := NewErrorResponse(cfg.Error)
+	if err != nil {
+		return nil, err
+	}
+	return &GinRateLimiter{
+		RateLimiter:    rateLimiter,
+		VaryBy:         varyBy,
+		KeyFunc:        keyFunc,
+		SubKeyFunc:     subKeyFunc,
+		Headers:        cfg.Headers,
+		DeniedResponse: denied,
+		ErrorResponse:  errorResponse,
+		FailurePolicy:  cfg.FailurePolicy,
+		OnFailure: func(c *gin.Context, err error) {
+			logger.Warning("RateLimit failed for", c.Request.URL.Path, ":", err.Error())
+		},
+	}, nil
+}
+
 // GinRateLimiter faciliates using a Limiter to limit HTTP requests.
 type GinRateLimiter struct {
+	// failures is the number of errors of the RateLimiter (see Failures).
+	// It is the first field, so it is 64 bit aligned for the atomic ops.
+	failures uint64
+
 	// DeniedHandler is called if the request is disallowed. If it is
-	// nil, the DefaultDeniedHandler variable is used.
+	// nil, the DeniedResponse or the DefaultDeniedHandler variable is used.
 	DeniedHandler gin.HandlerFunc
 
 	// Error is called if the RateLimiter returns an error. If it is
-	// nil, the DefaultErrorFunc is used.
+	// nil, the ErrorResponse or the DefaultErrorFunc is used.
 	Error func(*gin.Context, error)
 
+	// DeniedResponse and ErrorResponse are the configured responses
+	// (see NewGinRateLimiter).
+	DeniedResponse *ResponseTemplate
+	ErrorResponse  *ResponseTemplate
+
+	// FailurePolicy is what to do when the RateLimiter returns an error.
+	// With FailOpen the request is passed to the handler, otherwise the
+	// Error function is called. FailLocal is handled by the RateLimiter
+	// (see BuildRateLimiter).
+	FailurePolicy string
+
+	// OnFailure is called (if set) with every error of the RateLimiter,
+	// so the failures can be logged or counted. NewGinRateLimiter sets
+	// it to log them.
+	OnFailure func(c *gin.Context, err error)
+
 	// Limiter is call for each request to determine whether the
 	// request is permitted and update internal state. It must be set.
 	RateLimiter throttled.RateLimiter
@@ -138,70 +243,166 @@ type GinRateLimiter struct {
 	// VaryBy is called for each request to generate a key for the
 	// limiter. If it is nil, all requests use an empty string key.
 	VaryBy func(*gin.Context) string
+
+	// KeyFunc (if set) is called instead of VaryBy. The requests it
+	// returns no key for are passed to the DefaultMissingKeyHandler.
+	KeyFunc KeyFunc
+
+	// SubKeyFunc (if set) selects the sub key of the request (e.g. the
+	// user of the tenant) when the RateLimiter is a HierarchicalLimiter.
+	// The requests it returns no key for are passed to the
+	// DefaultMissingKeyHandler.
+	SubKeyFunc KeyFunc
+
+	// Headers selects the headers written to the response. The zero
+	// value writes the legacy X-RateLimit-* headers.
+	Headers HeadersConfig
 }
 
 // Requests that are not limited will be passed to the handler
 // unchanged.  Limited requests will be passed to the DeniedHandler.
-// X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset and
-// Retry-After headers will be written to the response based on the
-// values in the RateLimitResult.
+// The rate limit headers selected by Headers will be written to the
+// response based on the values in the RateLimitResult, and the
+// Retry-After header will be written to the limited ones.
 func (t *GinRateLimiter) RateLimit() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if t.RateLimiter == nil {
-			t.error(c, errors.New("You must set a RateLimiter on HTTPRateLimiter"))
+			t.error(c, "", errors.New("You must set a RateLimiter on HTTPRateLimiter"))
+			return
 		}
 
 		var key string
-		if t.VaryBy != nil {
+		if t.KeyFunc != nil {
+			k, ok := t.KeyFunc(c)
+			if !ok {
+				DefaultMissingKeyHandler(c)
+				return
+			}
+			key = k
+		} else if t.VaryBy != nil {
 			key = t.VaryBy(c)
 		}
 
-		limited, context, err := t.RateLimiter.RateLimit(key, 1)
+		rateLimit := t.RateLimiter.RateLimit
+		if hierarchical, ok := t.RateLimiter.(HierarchicalLimiter); ok && t.SubKeyFunc != nil {
+			subKey, found := t.SubKeyFunc(c)
+			if !found {
+				DefaultMissingKeyHandler(c)
+				return
+			}
+			rateLimit = func(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+				return hierarchical.RateLimitHierarchy(key, subKey, quantity)
+			}
+		}
+
+		limited, context, err := rateLimit(key, 1)
 
 		if err != nil {
-			t.error(c, err)
+			atomic.AddUint64(&t.failures, 1)
+			if t.OnFailure != nil {
+				t.OnFailure(c, err)
+			}
+			if t.FailurePolicy == FailOpen {
+				c.Next()
+				return
+			}
+			t.error(c, key, err)
 			return
 		}
 
-		setRateLimitHeaders(c, context)
+		policy, _ := rateLimitPolicy(t.RateLimiter, key)
+		setRateLimitHeaders(c, t.Headers, limited, context, policy)
 
 		if !limited {
 			c.Next()
 		} else {
-			dh := t.DeniedHandler
-			if dh == nil {
-				dh = DefaultDeniedHandler
-			}
-			dh(c)
+			t.deny(c, key, context, policy)
 		}
 	}
 }
 
-func (t *GinRateLimiter) error(c *gin.Context, err error) {
-	e := t.Error
-	if e == nil {
-		e = DefaultError
+// Failures returns the number of errors of the RateLimiter, whatever the FailurePolicy
+func (t *GinRateLimiter) Failures() uint64 {
+	return atomic.LoadUint64(&t.failures)
+}
+
+func (t *GinRateLimiter) deny(c *gin.Context, key string, result throttled.RateLimitResult, policy RateLimiterSettings) {
+	switch {
+	case t.DeniedHandler != nil:
+		t.DeniedHandler(c)
+	case t.DeniedResponse != nil:
+		t.DeniedResponse.Write(c, ResponseData{
+			Key:         key,
+			Result:      result,
+			MaxRequests: policy.maxRequests,
+			Period:      ceilSeconds(policy.period),
+		})
+	default:
+		DefaultDeniedHandler(c)
 	}
-	e(c, err)
 }
 
-func setRateLimitHeaders(c *gin.Context, context throttled.RateLimitResult) {
-	w := c.Writer
-	if v := context.Limit; v >= 0 {
-		w.Header().Add("X-RateLimit-Limit", strconv.Itoa(v))
+func (t *GinRateLimiter) error(c *gin.Context, key string, err error) {
+	switch {
+	case t.Error != nil:
+		t.Error(c, err)
+	case t.ErrorResponse != nil:
+		t.ErrorResponse.Write(c, ResponseData{Key: key, Error: err.Error()})
+	default:
+		DefaultError(c, err)
 	}
+}
 
-	if v := context.Remaining; v >= 0 {
-		w.Header().Add("X-RateLimit-Remaining", strconv.Itoa(v))
+// Name of the policy in the IETF headers (a structured field string)
+const ietfPolicyName = `"default"`
+
+// setRateLimitHeaders sets (instead of adding) the headers, so the last rate limiter of
+// a chain wins instead of sending duplicated values. RateLimit-Policy is only sent if the
+// policy (the settings applied to the key) is known
+func setRateLimitHeaders(c *gin.Context, headers HeadersConfig, limited bool, context throttled.RateLimitResult,
+	policy RateLimiterSettings) {
+	if headers.Format == NoHeaders {
+		return
+	}
+	h := c.Writer.Header()
+
+	if headers.Format == "" || headers.Format == LegacyHeaders || headers.Format == AllHeaders {
+		if v := context.Limit; v >= 0 {
+			h.Set("X-RateLimit-Limit", strconv.Itoa(v))
+		}
+		if v := context.Remaining; v >= 0 {
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(v))
+		}
+		if v := context.ResetAfter; v >= 0 {
+			h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(v)))
+		}
 	}
 
-	if v := context.ResetAfter; v >= 0 {
-		vi := int(math.Ceil(v.Seconds()))
-		w.Header().Add("X-RateLimit-Reset", strconv.Itoa(vi))
+	// RateLimit-Policy: "default";q=<max requests>;w=<period> and RateLimit: "default";r=<remaining>;t=<reset>
+	if headers.Format == IETFHeaders || headers.Format == AllHeaders {
+		if policy.maxRequests > 0 {
+			h.Set("RateLimit-Policy", ietfPolicyName+";q="+strconv.Itoa(policy.maxRequests)+
+				";w="+strconv.Itoa(ceilSeconds(policy.period)))
+		}
+		if v := context.Remaining; v >= 0 {
+			field := ietfPolicyName + ";r=" + strconv.Itoa(v)
+			if reset := context.ResetAfter; reset >= 0 {
+				field += ";t=" + strconv.Itoa(ceilSeconds(reset))
+			}
+			h.Set("RateLimit", field)
+		}
 	}
 
-	if v := context.RetryAfter; v >= 0 {
-		vi := int(math.Ceil(v.Seconds()))
-		w.Header().Add("Retry-After", strconv.Itoa(vi))
+	if v := context.RetryAfter; limited && v >= 0 {
+		if headers.RetryAfter == HTTPDateRetryAfter {
+			retry := time.Now().Add(time.Duration(ceilSeconds(v)) * time.Second)
+			h.Set("Retry-After", retry.UTC().Format(http.TimeFormat))
+		} else {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(v)))
+		}
 	}
 }
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -5,20 +5,27 @@
 package ratelimit
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/throttled/throttled"
 )
 
 func TestReadContextKey(t *testing.T) {
 	checks := []struct {
 		setKey   string
-		setValue string
+		setValue interface{}
 		getKey   string
 		expected string
 	}{
 		{setKey: "SiteKey", setValue: "issuer", getKey: "SiteKey", expected: "issuer"},
 		{setKey: "", setValue: "", getKey: "SiteKey", expected: "unknown"},
+		{setKey: "SiteKey", setValue: 42, getKey: "SiteKey", expected: "42"},
+		{setKey: "SiteKey", setValue: nil, getKey: "SiteKey", expected: "unknown"},
 	}
 
 	for _, c := range checks {
@@ -34,3 +41,141 @@ func TestReadContextKey(t *testing.T) {
 		}
 	}
 }
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	allowed := throttled.RateLimitResult{Limit: 10, Remaining: 4, ResetAfter: 1500 * time.Millisecond, RetryAfter: -1}
+	denied := throttled.RateLimitResult{Limit: 10, Remaining: 0, ResetAfter: 6 * time.Second, RetryAfter: 500 * time.Millisecond}
+	// 20 requests per minute and burst 9 (GCRA limit 10)
+	policy := RateLimiterSettings{maxRequests: 20, period: time.Minute, burstSize: 9}
+
+	checks := []struct {
+		name     string
+		headers  HeadersConfig
+		limited  bool
+		result   throttled.RateLimitResult
+		policy   RateLimiterSettings
+		expected http.Header
+	}{
+		{
+			name:    "legacy allowed",
+			headers: HeadersConfig{},
+			result:  allowed,
+			expected: http.Header{
+				"X-Ratelimit-Limit":     {"10"},
+				"X-Ratelimit-Remaining": {"4"},
+				"X-Ratelimit-Reset":     {"2"},
+			},
+		},
+		{
+			name:    "legacy denied",
+			headers: HeadersConfig{Format: LegacyHeaders},
+			limited: true,
+			result:  denied,
+			expected: http.Header{
+				"X-Ratelimit-Limit":     {"10"},
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {"6"},
+				"Retry-After":           {"1"},
+			},
+		},
+		{
+			name:    "ietf allowed",
+			headers: HeadersConfig{Format: IETFHeaders},
+			result:  allowed,
+			policy:  policy,
+			expected: http.Header{
+				"Ratelimit-Policy": {`"default";q=20;w=60`},
+				"Ratelimit":        {`"default";r=4;t=2`},
+			},
+		},
+		{
+			name:    "ietf unknown policy",
+			headers: HeadersConfig{Format: IETFHeaders},
+			result:  allowed,
+			expected: http.Header{
+				"Ratelimit": {`"default";r=4;t=2`},
+			},
+		},
+		{
+			name:    "both denied",
+			headers: HeadersConfig{Format: AllHeaders},
+			limited: true,
+			result:  denied,
+			policy:  policy,
+			expected: http.Header{
+				"X-Ratelimit-Limit":     {"10"},
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {"6"},
+				"Ratelimit-Policy":      {`"default";q=20;w=60`},
+				"Ratelimit":             {`"default";r=0;t=6`},
+				"Retry-After":           {"1"},
+			},
+		},
+		{
+			name:     "none",
+			headers:  HeadersConfig{Format: NoHeaders},
+			limited:  true,
+			result:   denied,
+			expected: http.Header{},
+		},
+	}
+
+	for _, c := range checks {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		// a second rate limiter in the chain replaces the headers instead of adding them
+		setRateLimitHeaders(ctx, c.headers, c.limited, c.result, c.policy)
+		setRateLimitHeaders(ctx, c.headers, c.limited, c.result, c.policy)
+		if got := w.Header(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: unexpected headers (expected: %v, got: %v)", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestSetRateLimitHeadersHTTPDate(t *testing.T) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	start := time.Now().Truncate(time.Second)
+	result := throttled.RateLimitResult{Limit: 10, Remaining: 0, ResetAfter: time.Minute, RetryAfter: 30 * time.Second}
+	setRateLimitHeaders(ctx, HeadersConfig{RetryAfter: HTTPDateRetryAfter}, true, result, RateLimiterSettings{})
+
+	retry, err := http.ParseTime(w.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Unexpected Retry-After header %q: %s", w.Header().Get("Retry-After"), err.Error())
+	}
+	if retry.Before(start.Add(30*time.Second)) || retry.After(time.Now().Add(31*time.Second)) {
+		t.Errorf("Unexpected Retry-After date (expected: about %s, got: %s)", start.Add(30*time.Second), retry)
+	}
+}
+
+func TestGinRateLimiterPolicyHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	clusterSettings := RateLimiterSettings{maxRequests: 10, period: time.Minute, burstSize: 4}
+	custom := map[string][]RateLimiterSettings{"kufar.com": {{maxRequests: 6, period: time.Hour, burstSize: 1}}}
+	rateLimiter, err := NewMultiRateLimiterWithWindows(factory, 2, []RateLimiterSettings{clusterSettings}, custom)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	rl := &GinRateLimiter{
+		RateLimiter: rateLimiter,
+		VaryBy:      func(c *gin.Context) string { return c.GetHeader("X-Tenant") },
+		Headers:     HeadersConfig{Format: IETFHeaders},
+	}
+	engine := gin.New()
+	engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	for tenant, expected := range map[string]string{
+		// the share of the node, not the GCRA limit (burst + 1)
+		"other.com": `"default";q=5;w=60`,
+		"kufar.com": `"default";q=3;w=3600`,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant", tenant)
+		engine.ServeHTTP(w, req)
+		if got := w.Header().Get("RateLimit-Policy"); got != expected {
+			t.Errorf("Unexpected RateLimit-Policy of %s (expected: %s, got: %s)", tenant, expected, got)
+		}
+	}
+}
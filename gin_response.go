@@ -0,0 +1,118 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/throttled/throttled"
+)
+
+// ProblemContentType is the content type of the RFC 7807 problem details. When it is
+// configured without a body, the responses are problem documents
+const ProblemContentType = "application/problem+json"
+
+const defaultContentType = "application/json; charset=utf-8"
+
+const (
+	deniedProblemBody = `{"type":"about:blank","title":{{json .Title}},"status":{{.StatusCode}},` +
+		`"detail":"Rate limit exceeded","tenant":{{json .Key}},{{with .MaxRequests}}"limit":{{.}},{{end}}"retry_after":{{.RetryAfter}}}`
+	errorProblemBody = `{"type":"about:blank","title":{{json .Title}},"status":{{.StatusCode}},` +
+		`"detail":"Rate limit unavailable"}`
+)
+
+// ResponseData is the data available to the body templates
+type ResponseData struct {
+	// Key is the rate limiter key of the request (e.g. the tenant)
+	Key string
+	// StatusCode and Title (its status text) of the response
+	StatusCode int
+	Title      string
+	// Result is the result of the denied request. It is empty in the error responses
+	Result throttled.RateLimitResult
+	// RetryAfter is Result.RetryAfter in seconds, rounded up
+	RetryAfter int
+	// MaxRequests per Period (in seconds) applied to the key (see PolicyLimiter), instead of
+	// Result.Limit (the burst size + 1). They are 0 if unknown
+	MaxRequests int
+	Period      int
+	// Error is the error of the rate limiter. It is empty in the denied responses
+	Error string
+}
+
+// ResponseTemplate writes the responses configured with a ResponseConfig
+type ResponseTemplate struct {
+	statusCode  int
+	contentType string
+	body        *template.Template
+}
+
+// NewDeniedResponse builds the response of the denied requests. It returns nil if cfg is empty
+func NewDeniedResponse(cfg ResponseConfig) (*ResponseTemplate, error) {
+	return newResponseTemplate(cfg, http.StatusTooManyRequests, `"limit exceeded"`, deniedProblemBody)
+}
+
+// NewErrorResponse builds the response of the rate limiter errors. It returns nil if cfg is empty
+func NewErrorResponse(cfg ResponseConfig) (*ResponseTemplate, error) {
+	return newResponseTemplate(cfg, http.StatusInternalServerError, `"internal error"`, errorProblemBody)
+}
+
+func newResponseTemplate(cfg ResponseConfig, statusCode int, body, problemBody string) (*ResponseTemplate, error) {
+	if cfg == (ResponseConfig{}) {
+		return nil, nil
+	}
+	r := &ResponseTemplate{statusCode: statusCode, contentType: defaultContentType}
+	if cfg.StatusCode != 0 {
+		r.statusCode = cfg.StatusCode
+	}
+	if cfg.ContentType != "" {
+		r.contentType = cfg.ContentType
+	}
+	switch {
+	case cfg.Body != "":
+		body = cfg.Body
+	case cfg.ContentType == ProblemContentType:
+		body = problemBody
+	}
+	tmpl, err := parseResponseBody(body)
+	if err != nil {
+		return nil, err
+	}
+	r.body = tmpl
+	return r, nil
+}
+
+// parseResponseBody parses a body template. The json function encodes a value as JSON
+// (e.g. {{json .Key}} writes a quoted and escaped string)
+func parseResponseBody(body string) (*template.Template, error) {
+	return template.New("body").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(body)
+}
+
+// Write aborts the request with the configured response
+func (r *ResponseTemplate) Write(c *gin.Context, data ResponseData) {
+	data.StatusCode = r.statusCode
+	data.Title = http.StatusText(r.statusCode)
+	if data.Result.RetryAfter > 0 {
+		data.RetryAfter = ceilSeconds(data.Result.RetryAfter)
+	}
+	buf := &bytes.Buffer{}
+	if err := r.body.Execute(buf, data); err != nil {
+		// the status code is still meaningful without the body
+		c.AbortWithStatus(r.statusCode)
+		return
+	}
+	c.Data(r.statusCode, r.contentType, buf.Bytes())
+	c.Abort()
+}
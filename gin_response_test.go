@@ -0,0 +1,206 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/throttled/throttled"
+)
+
+type mockPolicyLimiter struct {
+	*mockRateLimiter
+	policy RateLimiterSettings
+}
+
+func (m mockPolicyLimiter) Policy(string) (RateLimiterSettings, bool) {
+	return m.policy, true
+}
+
+func TestGinRateLimiterResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock := &mockRateLimiter{}
+	// 20 requests per minute and burst 9 (GCRA limit 10)
+	policyMock := mockPolicyLimiter{mockRateLimiter: mock, policy: RateLimiterSettings{maxRequests: 20, period: time.Minute, burstSize: 9}}
+	mock.mockRequest(rateLimitRequest{key: "kufar.com", quantity: 1}, rateLimitResponse{
+		limited: true,
+		result:  throttled.RateLimitResult{Limit: 10, Remaining: 0, ResetAfter: time.Minute, RetryAfter: 1500 * time.Millisecond},
+	})
+
+	checks := []struct {
+		name                string
+		key                 string
+		rateLimiter         throttled.RateLimiter
+		cfg                 RateLimitConfig
+		expectedStatus      int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "default denied",
+			key:                 "kufar.com",
+			expectedStatus:      http.StatusTooManyRequests,
+			expectedContentType: "application/json; charset=utf-8",
+			expectedBody:        `"limit exceeded"`,
+		},
+		{
+			name:                "default error",
+			key:                 "unknown",
+			expectedStatus:      http.StatusInternalServerError,
+			expectedContentType: "application/json; charset=utf-8",
+			expectedBody:        `"internal error"`,
+		},
+		{
+			name:                "problem denied",
+			key:                 "kufar.com",
+			rateLimiter:         policyMock,
+			cfg:                 RateLimitConfig{Denied: ResponseConfig{ContentType: ProblemContentType}},
+			expectedStatus:      http.StatusTooManyRequests,
+			expectedContentType: ProblemContentType,
+			expectedBody: `{"type":"about:blank","title":"Too Many Requests","status":429,` +
+				`"detail":"Rate limit exceeded","tenant":"kufar.com","limit":20,"retry_after":2}`,
+		},
+		{
+			name:                "problem denied without policy",
+			key:                 "kufar.com",
+			cfg:                 RateLimitConfig{Denied: ResponseConfig{ContentType: ProblemContentType}},
+			expectedStatus:      http.StatusTooManyRequests,
+			expectedContentType: ProblemContentType,
+			expectedBody: `{"type":"about:blank","title":"Too Many Requests","status":429,` +
+				`"detail":"Rate limit exceeded","tenant":"kufar.com","retry_after":2}`,
+		},
+		{
+			name:                "problem error",
+			key:                 "unknown",
+			cfg:                 RateLimitConfig{Error: ResponseConfig{StatusCode: 503, ContentType: ProblemContentType}},
+			expectedStatus:      http.StatusServiceUnavailable,
+			expectedContentType: ProblemContentType,
+			expectedBody:        `{"type":"about:blank","title":"Service Unavailable","status":503,"detail":"Rate limit unavailable"}`,
+		},
+		{
+			name: "template",
+			key:  "kufar.com",
+			cfg: RateLimitConfig{Denied: ResponseConfig{
+				StatusCode:  503,
+				ContentType: "text/plain",
+				Body:        "{{.Key}}: {{.MaxRequests}} requests per {{.Period}}s, retry in {{.RetryAfter}}s",
+			}},
+			rateLimiter:         policyMock,
+			expectedStatus:      http.StatusServiceUnavailable,
+			expectedContentType: "text/plain",
+			expectedBody:        "kufar.com: 20 requests per 60s, retry in 2s",
+		},
+	}
+
+	for _, c := range checks {
+		var rateLimiter throttled.RateLimiter = mock
+		if c.rateLimiter != nil {
+			rateLimiter = c.rateLimiter
+		}
+		rl, err := NewGinRateLimiter(rateLimiter, func(*gin.Context) string { return c.key }, c.cfg, logging.NoOp)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		engine := gin.New()
+		engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		engine.ServeHTTP(w, req)
+		if w.Code != c.expectedStatus {
+			t.Errorf("%s: unexpected status (expected: %d, got: %d)", c.name, c.expectedStatus, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != c.expectedContentType {
+			t.Errorf("%s: unexpected content type (expected: %s, got: %s)", c.name, c.expectedContentType, ct)
+		}
+		if body := w.Body.String(); body != c.expectedBody {
+			t.Errorf("%s: unexpected body (expected: %s, got: %s)", c.name, c.expectedBody, body)
+		}
+	}
+}
+
+func TestDeniedProblemIsValidJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r, err := NewDeniedResponse(ResponseConfig{ContentType: ProblemContentType})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	r.Write(ctx, ResponseData{Key: `"quoted" tenant`, Result: throttled.RateLimitResult{Limit: 5, RetryAfter: time.Second}, MaxRequests: 8})
+
+	problem := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Invalid problem document %s: %s", w.Body.String(), err.Error())
+	}
+	expected := map[string]interface{}{
+		"type":        "about:blank",
+		"title":       "Too Many Requests",
+		"status":      float64(429),
+		"detail":      "Rate limit exceeded",
+		"tenant":      `"quoted" tenant`,
+		"limit":       float64(8),
+		"retry_after": float64(1),
+	}
+	if !reflect.DeepEqual(problem, expected) {
+		t.Errorf("Unexpected problem document (expected: %v, got: %v)", expected, problem)
+	}
+	if !ctx.IsAborted() {
+		t.Errorf("The request should be aborted")
+	}
+}
+
+func TestNewGinRateLimiterInvalidTemplate(t *testing.T) {
+	if _, err := NewGinRateLimiter(&mockRateLimiter{}, nil, RateLimitConfig{Denied: ResponseConfig{Body: "{{.Key"}}, logging.NoOp); err == nil {
+		t.Errorf("An error is expected for an invalid body template")
+	}
+	if r, err := NewErrorResponse(ResponseConfig{}); r != nil || err != nil {
+		t.Errorf("Unexpected response for an empty config (expected: nil, got: %v, %v)", r, err)
+	}
+}
+
+func TestGinRateLimiterFailurePolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	checks := []struct {
+		policy         string
+		expectedStatus int
+	}{
+		{policy: "", expectedStatus: http.StatusInternalServerError},
+		{policy: FailClosed, expectedStatus: http.StatusInternalServerError},
+		{policy: FailOpen, expectedStatus: http.StatusOK},
+	}
+
+	for _, c := range checks {
+		var logs bytes.Buffer
+		logger, _ := logging.NewLogger("WARNING", &logs, "")
+		// the mock fails for every unexpected key
+		rl, _ := NewGinRateLimiter(&mockRateLimiter{}, nil, RateLimitConfig{FailurePolicy: c.policy}, logger)
+		engine := gin.New()
+		engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		engine.ServeHTTP(w, req)
+		if w.Code != c.expectedStatus {
+			t.Errorf("Unexpected status with policy %q (expected: %d, got: %d)", c.policy, c.expectedStatus, w.Code)
+		}
+		if n := rl.Failures(); n != 1 {
+			t.Errorf("Unexpected failures with policy %q (expected: 1, got: %d)", c.policy, n)
+		}
+		if !strings.Contains(logs.String(), "RateLimit failed for / :") {
+			t.Errorf("The failure should be logged with policy %q: %s", c.policy, logs.String())
+		}
+	}
+}
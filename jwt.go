@@ -0,0 +1,278 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+var (
+	errMalformedToken   = errors.New("malformed JWT")
+	errInvalidSignature = errors.New("invalid JWT signature")
+	errExpiredToken     = errors.New("expired JWT")
+	errNotValidYet      = errors.New("JWT not valid yet")
+)
+
+// Clock skew tolerated when checking the exp and nbf claims
+const jwtLeeway = time.Minute
+
+// Claim used as key when no claim is configured
+const defaultJWTClaim = "iss"
+
+// Minimum size of the HMAC secrets, the output size of HS256 (RFC 7518 section 3.2)
+const minJWTSecretSize = 32
+
+// Minimum size of the RSA keys (RFC 7518 section 3.3)
+const minJWTRSAKeyBits = 2048
+
+// Signing algorithms of the verified tokens. Each key only verifies the algorithms of its type
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.HS256, jose.HS384, jose.HS512,
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+}
+
+// JWTVerifier reads the claims of the bearer tokens, verifying their signature with the
+// configured HMAC secret or JSON Web Key Set, and their exp and nbf claims. The signatures
+// are verified by go-jose
+type JWTVerifier struct {
+	claim      string
+	unverified bool
+	secret     []byte
+	keys       []jose.JSONWebKey
+	now        func() time.Time
+}
+
+// NewJWTVerifier builds the verifier of the config. The JWK file is read once
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{claim: cfg.Claim, unverified: cfg.Unverified, now: time.Now}
+	if v.claim == "" {
+		v.claim = defaultJWTClaim
+	}
+	switch {
+	case cfg.Unverified:
+	case cfg.Secret != "":
+		if len(cfg.Secret) < minJWTSecretSize {
+			return nil, fmt.Errorf("the JWT secret must have %d bytes at least", minJWTSecretSize)
+		}
+		v.secret = []byte(cfg.Secret)
+	case cfg.JWKFile != "":
+		data, err := ioutil.ReadFile(cfg.JWKFile)
+		if err != nil {
+			return nil, err
+		}
+		if v.keys, err = parseJWKS(data); err != nil {
+			return nil, fmt.Errorf("invalid JWK file %s: %s", cfg.JWKFile, err.Error())
+		}
+	default:
+		return nil, errors.New("a JWK file, a secret or unverified tokens are required")
+	}
+	return v, nil
+}
+
+// KeyFunc returns a KeyFunc using the configured claim of the bearer token. Requests without
+// a valid token or without the claim follow the missing key policy (see KeyBuilder)
+func (v *JWTVerifier) KeyFunc(missing string) KeyFunc {
+	// the claim source never fails with a verifier
+	b, _ := NewKeyBuilder(KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: v.claim}}, Missing: missing}, nil, v)
+	return b.Key
+}
+
+// Claims returns the claims of the bearer token of the request. The KeyBuilder only calls
+// it once per request (see contextClaims)
+func (v *JWTVerifier) Claims(r *http.Request) (map[string]interface{}, error) {
+	token := bearerToken(r)
+	if v.unverified {
+		return unverifiedClaims(token)
+	}
+	return v.verify(token)
+}
+
+func (v *JWTVerifier) verify(token string) (map[string]interface{}, error) {
+	jws, err := jose.ParseSignedCompact(token, jwtAlgorithms)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	payload, err := v.verifySignature(jws)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := decodeClaims(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := v.now()
+	if exp, ok := numericClaim(claims, "exp"); ok && now.Add(-jwtLeeway).Unix() >= exp {
+		return nil, errExpiredToken
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(jwtLeeway).Unix() < nbf {
+		return nil, errNotValidYet
+	}
+	return claims, nil
+}
+
+// verifySignature returns the payload of the token if it is signed by the secret or by one
+// of the keys with its kid (every key if it has none) and its alg (if the key has one)
+func (v *JWTVerifier) verifySignature(jws *jose.JSONWebSignature) ([]byte, error) {
+	if v.secret != nil {
+		if payload, err := jws.Verify(v.secret); err == nil {
+			return payload, nil
+		}
+		return nil, errInvalidSignature
+	}
+	header := jws.Signatures[0].Header
+	for _, k := range v.keys {
+		if (header.KeyID != "" && k.KeyID != header.KeyID) || (k.Algorithm != "" && k.Algorithm != header.Algorithm) {
+			continue
+		}
+		if payload, err := jws.Verify(k.Key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errInvalidSignature
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return int64(f), err == nil
+}
+
+// parseJWKS parses the RSA, EC and symmetric (oct) signing keys of a JSON Web Key Set.
+// Encryption keys and unknown key types are ignored
+func parseJWKS(data []byte) ([]jose.JSONWebKey, error) {
+	set := struct {
+		Keys []json.RawMessage `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := []jose.JSONWebKey{}
+	for i, raw := range set.Keys {
+		k := struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+		}{}
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return nil, fmt.Errorf("invalid key %d: %s", i, err.Error())
+		}
+		if (k.Use != "" && k.Use != "sig") || (k.Kty != "RSA" && k.Kty != "EC" && k.Kty != "oct") {
+			continue
+		}
+		key := jose.JSONWebKey{}
+		if err := key.UnmarshalJSON(raw); err != nil {
+			return nil, fmt.Errorf("invalid %s key %d: %s", k.Kty, i, err.Error())
+		}
+		switch k := key.Key.(type) {
+		case *rsa.PublicKey:
+			if k.N.BitLen() < minJWTRSAKeyBits {
+				return nil, fmt.Errorf("invalid RSA key %d: %d bits, %d at least", i, k.N.BitLen(), minJWTRSAKeyBits)
+			}
+		case []byte:
+			if len(k) == 0 {
+				return nil, fmt.Errorf("invalid symmetric key %d", i)
+			}
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			// only the public part is needed to verify
+			key = key.Public()
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys found")
+	}
+	return keys, nil
+}
+
+// bearerToken returns the token of the Authorization header (Authorization: Bearer <token>)
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// unverifiedClaims decodes the claims of a JWS compact token without checking its signature,
+// so they can only be trusted if the token was validated before
+func unverifiedClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	return decodeClaims(payload)
+}
+
+func decodeClaims(payload []byte) (map[string]interface{}, error) {
+	claims := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	// keep the numeric claims as written (e.g. big user ids)
+	d.UseNumber()
+	if err := d.Decode(&claims); err != nil {
+		return nil, errMalformedToken
+	}
+	return claims, nil
+}
+
+// claimValue returns the claim as a string. Nested claims are selected with a dot separated
+// path (e.g. realm.tenant), unless a top level claim has that name (e.g. https://example.com/tenant)
+func claimValue(claims map[string]interface{}, name string) (string, bool) {
+	v, ok := claims[name]
+	if !ok {
+		v, ok = nestedClaim(claims, strings.Split(name, "."))
+	}
+	if !ok {
+		return "", false
+	}
+	switch value := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, value != ""
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	default:
+		b, err := json.Marshal(value)
+		return string(b), err == nil
+	}
+}
+
+func nestedClaim(claims map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = claims
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
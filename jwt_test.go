@@ -0,0 +1,445 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// testJWTSecret is long enough for HS512 (RFC 7518 section 3.2)
+const testJWTSecret = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// signedToken signs the payload with an HMAC secret or an RSA or EC private key
+func signedToken(t *testing.T, alg, kid string, key interface{}, payload string) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString([]byte(payload))
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if alg[:2] == "PS" {
+			signature, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		if err == nil {
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error signing the token: %s", err.Error())
+	}
+	return signingInput + "." + enc.EncodeToString(signature)
+}
+
+// ecCoordinate encodes a coordinate of the EC key with the size of its curve (RFC 7518 section 6.2.1.2)
+func ecCoordinate(k *ecdsa.PrivateKey, v *big.Int) string {
+	b := make([]byte, (k.Curve.Params().BitSize+7)/8)
+	return base64.RawURLEncoding.EncodeToString(v.FillBytes(b))
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Unexpected error writing the JWK file: %s", err.Error())
+	}
+	return path
+}
+
+func TestJWTVerifier(t *testing.T) {
+	enc := base64.RawURLEncoding
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherRSAKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	secret := []byte(testJWTSecret)
+
+	jwks := writeJWKS(t,
+		map[string]string{
+			"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": enc.EncodeToString(rsaKey.N.Bytes()),
+			"e": enc.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		map[string]string{
+			"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": ecCoordinate(ecKey, ecKey.X), "y": ecCoordinate(ecKey, ecKey.Y),
+		},
+		map[string]string{
+			"kty": "EC", "kid": "ec521", "crv": "P-521", "alg": "ES512",
+			"x": ecCoordinate(ec521Key, ec521Key.X), "y": ecCoordinate(ec521Key, ec521Key.Y),
+		},
+		map[string]string{"kty": "oct", "kid": "hmac", "k": enc.EncodeToString(secret)},
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	)
+	now := time.Unix(1500000000, 0)
+	payload := `{"iss":"kufar.com","sub":"user-1","realm":{"tenant":"corotos.com"},"exp":1500000600}`
+	// the payload of a token with the signature of another one
+	signed := signedToken(t, "HS256", "", secret, payload)
+	forged := signedToken(t, "HS256", "", secret, `{"iss":"corotos.com"}`)
+	tampered := forged[:strings.LastIndex(forged, ".")] + signed[strings.LastIndex(signed, "."):]
+
+	checks := []struct {
+		name     string
+		cfg      JWTConfig
+		token    string
+		expected string
+	}{
+		{
+			name:     "hmac secret",
+			cfg:      JWTConfig{Secret: string(secret)},
+			token:    signedToken(t, "HS256", "", secret, payload),
+			expected: "kufar.com",
+		},
+		{
+			name:     "hmac secret hs512",
+			cfg:      JWTConfig{Secret: string(secret), Claim: "sub"},
+			token:    signedToken(t, "HS512", "", secret, payload),
+			expected: "user-1",
+		},
+		{
+			name:     "wrong hmac secret",
+			cfg:      JWTConfig{Secret: strings.ToUpper(testJWTSecret)},
+			token:    signedToken(t, "HS256", "", secret, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "rs256",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "RS256", "rsa", rsaKey, payload),
+			expected: "kufar.com",
+		},
+		{
+			name:     "ps384 without kid",
+			cfg:      JWTConfig{JWKFile: jwks, Claim: "realm.tenant"},
+			token:    signedToken(t, "PS384", "", rsaKey, payload),
+			expected: "corotos.com",
+		},
+		{
+			name:     "es256",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "ES256", "ec", ecKey, payload),
+			expected: "kufar.com",
+		},
+		{
+			name:     "es512",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "ES512", "ec521", ec521Key, payload),
+			expected: "kufar.com",
+		},
+		{
+			name:     "es384 with a P-256 key",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "ES384", "ec", ecKey, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "symmetric jwk",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "HS384", "hmac", secret, payload),
+			expected: "kufar.com",
+		},
+		{
+			name:     "unknown signing key",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "RS256", "rsa", otherRSAKey, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "kid of another key",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "RS256", "hmac", rsaKey, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "hmac signed with the public RSA modulus",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "HS256", "rsa", rsaKey.N.Bytes(), payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "es256 signed with the RSA key",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "ES256", "rsa", rsaKey, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "ps256 with the kid of an EC key",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "PS256", "ec", rsaKey, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "rs512 with the kid of an ES512 key",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "RS512", "ec521", rsaKey, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "hs512 signed with the secret of a jwk",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "HS512", "", secret, payload),
+			expected: "kufar.com",
+		},
+		{
+			name:     "hmac signed with the public RSA modulus without kid",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    signedToken(t, "HS256", "", rsaKey.N.Bytes(), payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "alg none with a secret",
+			cfg:      JWTConfig{Secret: string(secret)},
+			token:    unsignedToken(payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "alg none",
+			cfg:      JWTConfig{JWKFile: jwks},
+			token:    unsignedToken(payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "tampered payload",
+			cfg:      JWTConfig{Secret: string(secret)},
+			token:    tampered,
+			expected: AnonymousKey,
+		},
+		{
+			name:     "expired",
+			cfg:      JWTConfig{Secret: string(secret)},
+			token:    signedToken(t, "HS256", "", secret, `{"iss":"kufar.com","exp":1499999900}`),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "expired within the leeway",
+			cfg:      JWTConfig{Secret: string(secret)},
+			token:    signedToken(t, "HS256", "", secret, `{"iss":"kufar.com","exp":1499999970}`),
+			expected: "kufar.com",
+		},
+		{
+			name:     "not valid yet",
+			cfg:      JWTConfig{Secret: string(secret)},
+			token:    signedToken(t, "HS256", "", secret, `{"iss":"kufar.com","nbf":1500000300}`),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "missing claim",
+			cfg:      JWTConfig{Secret: string(secret), Claim: "azp"},
+			token:    signedToken(t, "HS256", "", secret, payload),
+			expected: AnonymousKey,
+		},
+		{
+			name:     "unverified",
+			cfg:      JWTConfig{Unverified: true, Claim: "realm.tenant"},
+			token:    unsignedToken(payload),
+			expected: "corotos.com",
+		},
+		{
+			name:     "unverified malformed token",
+			cfg:      JWTConfig{Unverified: true},
+			token:    "not-a-token",
+			expected: AnonymousKey,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, c := range checks {
+		v, err := NewJWTVerifier(c.cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		v.now = func() time.Time { return now }
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request, _ = http.NewRequest("GET", "/", nil)
+		ctx.Request.Header.Set("Authorization", "Bearer "+c.token)
+		if key, _ := v.KeyFunc(MissingKeyShared)(ctx); key != c.expected {
+			t.Errorf("%s: unexpected key (expected: %s, got: %s)", c.name, c.expected, key)
+		}
+		// the invalid tokens are not keyed apart from the missing ones
+		if _, found := v.KeyFunc(MissingKeyReject)(ctx); found != (c.expected != AnonymousKey) {
+			t.Errorf("%s: unexpected found value with the reject policy (got: %t)", c.name, found)
+		}
+	}
+}
+
+// The examples of RFC 7515 (appendix A.1 and A.3) verified with their keys
+func TestJWTVerifierRFC7515(t *testing.T) {
+	jwks := writeJWKS(t,
+		map[string]string{
+			"kty": "oct",
+			"k":   "AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow",
+		},
+		map[string]string{
+			"kty": "EC", "crv": "P-256",
+			"x": "f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+			"y": "x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0",
+		},
+	)
+	payload := "eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ"
+	checks := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{
+			name:     "hs256",
+			token:    "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9." + payload + ".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+			expected: "true",
+		},
+		{
+			name:     "es256",
+			token:    "eyJhbGciOiJFUzI1NiJ9." + payload + ".DtEhU3ljbEg8L38VWAfUAqOyKAM6-Xx-F4GawxaepmXFCgfTjDxw5djxLa8ISlSApmWQxfKTUJqPP3-Kg6NU1Q",
+			expected: "true",
+		},
+		{
+			name:     "es256 header with the hs256 signature",
+			token:    "eyJhbGciOiJFUzI1NiJ9." + payload + ".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+			expected: AnonymousKey,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	v, err := NewJWTVerifier(JWTConfig{JWKFile: jwks, Claim: "http://example.com/is_root"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	v.now = func() time.Time { return time.Unix(1300819000, 0) }
+	for _, c := range checks {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request, _ = http.NewRequest("GET", "/", nil)
+		ctx.Request.Header.Set("Authorization", "Bearer "+c.token)
+		if key, _ := v.KeyFunc(MissingKeyShared)(ctx); key != c.expected {
+			t.Errorf("%s: unexpected key (expected: %s, got: %s)", c.name, c.expected, key)
+		}
+	}
+}
+
+func TestJWTVerifierOncePerRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	v, _ := NewJWTVerifier(JWTConfig{Secret: testJWTSecret})
+	verifications := 0
+	v.now = func() time.Time {
+		verifications++
+		return time.Now()
+	}
+	other, _ := NewJWTVerifier(JWTConfig{Secret: testJWTSecret})
+	key, _ := NewKeyBuilder(KeyConfig{Sources: []KeySource{{Type: CompositeKeySource, Parts: []KeySource{
+		{Type: ClaimKeySource, Name: "iss"},
+		{Type: ClaimKeySource, Name: "azp"},
+	}}}}, nil, v)
+	subKey, _ := NewKeyBuilder(KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: "sub"}}}, nil, v)
+	otherKey, _ := NewKeyBuilder(KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: "sub"}}}, nil, other)
+
+	for i := 0; i < 2; i++ {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request, _ = http.NewRequest("GET", "/", nil)
+		token := signedToken(t, "HS256", "", []byte(testJWTSecret), `{"iss":"kufar.com","azp":"web","sub":"user-1"}`)
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		if k, _ := key.Key(ctx); k != "kufar.com:web" {
+			t.Errorf("Unexpected key (expected: kufar.com:web, got: %s)", k)
+		}
+		if k, _ := subKey.Key(ctx); k != "user-1" {
+			t.Errorf("Unexpected sub key (expected: user-1, got: %s)", k)
+		}
+		// the claims of another verifier are not shared
+		if k, _ := otherKey.Key(ctx); k != "user-1" {
+			t.Errorf("Unexpected key of the other verifier (expected: user-1, got: %s)", k)
+		}
+		if verifications != i+1 {
+			t.Errorf("The token should be verified once per request (expected: %d, got: %d)", i+1, verifications)
+		}
+	}
+}
+
+func TestNewJWTVerifierErrors(t *testing.T) {
+	for _, cfg := range []JWTConfig{
+		{},
+		{Secret: "s3cr3t"},
+		{JWKFile: filepath.Join(t.TempDir(), "missing.json")},
+		{JWKFile: writeJWKS(t, map[string]string{"kty": "EC", "crv": "P-256", "x": "AQAB", "y": "AQAB"})},
+		{JWKFile: writeJWKS(t, map[string]string{"kty": "RSA", "n": "", "e": "AQAB"})},
+		// a 512 bits RSA key
+		{JWKFile: writeJWKS(t, map[string]string{"kty": "RSA", "n": base64.RawURLEncoding.EncodeToString(append([]byte{0xc1}, make([]byte, 63)...)), "e": "AQAB"})},
+		{JWKFile: writeJWKS(t, map[string]string{"kty": "OKP", "crv": "Ed25519", "x": "AQAB"})},
+	} {
+		if _, err := NewJWTVerifier(cfg); err == nil {
+			t.Errorf("An error is expected for %+v", cfg)
+		}
+	}
+}
+
+func TestGinRateLimiterJWT(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	secret := []byte(testJWTSecret)
+	mock := &mockRateLimiter{}
+	mock.mockRequest(rateLimitRequest{key: "kufar.com", quantity: 1}, rateLimitResponse{})
+
+	checks := []struct {
+		name     string
+		missing  string
+		token    string
+		expected int
+	}{
+		{name: "valid token", token: signedToken(t, "HS256", "", secret, `{"iss":"kufar.com"}`), expected: http.StatusOK},
+		// the mock fails for any other key
+		{name: "forged token", token: unsignedToken(`{"iss":"kufar.com"}`), expected: http.StatusInternalServerError},
+		{name: "rejected forged token", missing: MissingKeyReject, token: unsignedToken(`{"iss":"kufar.com"}`), expected: http.StatusUnauthorized},
+	}
+
+	for _, c := range checks {
+		cfg := RateLimitConfig{JWT: JWTConfig{Secret: string(secret)}, Key: KeyConfig{Missing: c.missing}}
+		rl, err := NewGinRateLimiter(mock, IpVaryBy(), cfg, logging.NoOp)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", c.name, err.Error())
+		}
+		engine := gin.New()
+		engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		engine.ServeHTTP(w, req)
+		if w.Code != c.expected {
+			t.Errorf("%s: unexpected status (expected: %d, got: %d)", c.name, c.expected, w.Code)
+		}
+	}
+}
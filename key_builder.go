@@ -0,0 +1,188 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnonymousKey is the key shared by the requests without key when the missing key
+// policy is MissingKeyShared
+const AnonymousKey = "anonymous"
+
+// Separator of the parts of the composite keys (e.g. kufar.com:203.0.113.7)
+const compositeKeySeparator = ":"
+
+// Context key of the claims of the request verified by a JWTVerifier (see contextClaims)
+const jwtClaimsContextKey = "github.com/schibsted/krakend-ratelimit/jwt-claims"
+
+// DefaultMissingKeyHandler rejects the requests without key when the missing key
+// policy is MissingKeyReject. It returns a 401 status code with a generic message
+var DefaultMissingKeyHandler = func(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, "missing rate limit key")
+}
+
+// KeyFunc returns the rate limiter key of the request. It returns false if the request
+// has no key and must be rejected
+type KeyFunc func(*gin.Context) (string, bool)
+
+// keySource returns the key found by a KeySource
+type keySource func(*gin.Context) (string, bool)
+
+// KeyBuilder builds the rate limiter key of the requests from a KeyConfig. The sources
+// are tried in order and the first one found is the key
+type KeyBuilder struct {
+	sources []keySource
+	missing string
+	ip      *ClientIPResolver
+	jwt     *JWTVerifier
+}
+
+// NewKeyBuilder builds the KeyBuilder of the config. The IP source and the MissingKeyIP
+// policy use the ip resolver (or the remote address if it is nil). The claim sources require
+// the jwt verifier, unverified if the tokens were validated before
+func NewKeyBuilder(cfg KeyConfig, ip *ClientIPResolver, jwt *JWTVerifier) (*KeyBuilder, error) {
+	if ip == nil {
+		ip, _ = NewClientIPResolver(ClientIPConfig{})
+	}
+	b := &KeyBuilder{missing: cfg.Missing, ip: ip, jwt: jwt}
+	for _, s := range cfg.Sources {
+		source, err := b.source(s)
+		if err != nil {
+			return nil, err
+		}
+		b.sources = append(b.sources, source)
+	}
+	return b, nil
+}
+
+func (b *KeyBuilder) source(s KeySource) (keySource, error) {
+	name := s.Name
+	switch s.Type {
+	case HeaderKeySource:
+		return func(c *gin.Context) (string, bool) {
+			v := c.GetHeader(name)
+			return v, v != ""
+		}, nil
+	case QueryKeySource:
+		return func(c *gin.Context) (string, bool) {
+			v := c.Query(name)
+			return v, v != ""
+		}, nil
+	case ParamKeySource:
+		return func(c *gin.Context) (string, bool) {
+			v := c.Param(name)
+			return v, v != ""
+		}, nil
+	case CookieKeySource:
+		return func(c *gin.Context) (string, bool) {
+			v, err := c.Cookie(name)
+			return v, err == nil && v != ""
+		}, nil
+	case ClaimKeySource:
+		if b.jwt == nil {
+			return nil, fmt.Errorf("claim key sources require a jwt verifier (set jwt.unverified if the tokens are validated before)")
+		}
+		return func(c *gin.Context) (string, bool) {
+			claims, err := contextClaims(c, b.jwt)
+			if err != nil {
+				return "", false
+			}
+			return claimValue(claims, name)
+		}, nil
+	case ContextKeySource:
+		return func(c *gin.Context) (string, bool) {
+			v, ok := c.Get(name)
+			if !ok || v == nil {
+				return "", false
+			}
+			s := contextValue(v)
+			return s, s != ""
+		}, nil
+	case IPKeySource:
+		return func(c *gin.Context) (string, bool) {
+			return b.ip.Key(c.Request), true
+		}, nil
+	case CompositeKeySource:
+		parts := make([]keySource, len(s.Parts))
+		for i, p := range s.Parts {
+			if p.Type == CompositeKeySource {
+				return nil, fmt.Errorf("composite key sources can not be nested")
+			}
+			part, err := b.source(p)
+			if err != nil {
+				return nil, err
+			}
+			parts[i] = part
+		}
+		return func(c *gin.Context) (string, bool) {
+			values := make([]string, len(parts))
+			for i, part := range parts {
+				v, ok := part(c)
+				if !ok {
+					return "", false
+				}
+				values[i] = v
+			}
+			return strings.Join(values, compositeKeySeparator), true
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown key source type '%s'", s.Type)
+}
+
+// Key returns the key of the first source found or, if none is found, the key of the
+// missing key policy
+func (b *KeyBuilder) Key(c *gin.Context) (string, bool) {
+	for _, source := range b.sources {
+		if key, ok := source(c); ok {
+			return key, true
+		}
+	}
+	switch b.missing {
+	case MissingKeyReject:
+		return "", false
+	case MissingKeyIP:
+		return b.ip.Key(c.Request), true
+	default:
+		return AnonymousKey, true
+	}
+}
+
+// verifiedClaims are the claims of the request verified by a JWTVerifier, or its error
+type verifiedClaims struct {
+	verifier *JWTVerifier
+	claims   map[string]interface{}
+	err      error
+}
+
+// contextClaims verifies the bearer token of the request once per verifier and stores the
+// result in the gin context, so the claim sources of the key and of the sub key share it
+func contextClaims(c *gin.Context, verifier *JWTVerifier) (map[string]interface{}, error) {
+	if v, ok := c.Get(jwtClaimsContextKey); ok {
+		if cached, ok := v.(verifiedClaims); ok && cached.verifier == verifier {
+			return cached.claims, cached.err
+		}
+	}
+	claims, err := verifier.Claims(c.Request)
+	c.Set(jwtClaimsContextKey, verifiedClaims{verifier: verifier, claims: claims, err: err})
+	return claims, err
+}
+
+// contextValue formats the values stored in the gin context
+func contextValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case fmt.Stringer:
+		return value.String()
+	default:
+		return fmt.Sprint(value)
+	}
+}
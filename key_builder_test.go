@@ -0,0 +1,218 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// unsignedToken builds a token with the given payload. The signature is not checked
+// by the unverified claim key sources
+func unsignedToken(payload string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestKeyBuilder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	token := unsignedToken(`{"iss":"kufar.com","uid":1234567890123,"realm":{"tenant":"corotos.com"},"https://example.com/org":"acme"}`)
+
+	checks := []struct {
+		name     string
+		cfg      KeyConfig
+		url      string
+		headers  map[string]string
+		context  map[string]interface{}
+		expected string
+		found    bool
+	}{
+		{
+			name:     "header",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-Api-Key"}}},
+			headers:  map[string]string{"X-Api-Key": "secret"},
+			expected: "secret",
+			found:    true,
+		},
+		{
+			name:     "query",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: QueryKeySource, Name: "api_key"}}},
+			url:      "/items/42?api_key=secret",
+			expected: "secret",
+			found:    true,
+		},
+		{
+			name:     "path param",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: ParamKeySource, Name: "id"}}},
+			expected: "42",
+			found:    true,
+		},
+		{
+			name:     "cookie",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: CookieKeySource, Name: "session"}}},
+			headers:  map[string]string{"Cookie": "session=abc; other=1"},
+			expected: "abc",
+			found:    true,
+		},
+		{
+			name:     "claim",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: "iss"}}},
+			headers:  map[string]string{"Authorization": "Bearer " + token},
+			expected: "kufar.com",
+			found:    true,
+		},
+		{
+			name:     "numeric claim",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: "uid"}}},
+			headers:  map[string]string{"Authorization": "bearer " + token},
+			expected: "1234567890123",
+			found:    true,
+		},
+		{
+			name:     "nested claim",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: "realm.tenant"}}},
+			headers:  map[string]string{"Authorization": "Bearer " + token},
+			expected: "corotos.com",
+			found:    true,
+		},
+		{
+			name:     "claim with dots in its name",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: ClaimKeySource, Name: "https://example.com/org"}}},
+			headers:  map[string]string{"Authorization": "Bearer " + token},
+			expected: "acme",
+			found:    true,
+		},
+		{
+			name:     "context value",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: ContextKeySource, Name: "SiteKey"}}},
+			context:  map[string]interface{}{"SiteKey": 42},
+			expected: "42",
+			found:    true,
+		},
+		{
+			name:     "ip",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: IPKeySource}}},
+			expected: "203.0.113.7",
+			found:    true,
+		},
+		{
+			name: "composite",
+			cfg: KeyConfig{Sources: []KeySource{{Type: CompositeKeySource, Parts: []KeySource{
+				{Type: ContextKeySource, Name: "SiteKey"},
+				{Type: IPKeySource},
+			}}}},
+			context:  map[string]interface{}{"SiteKey": "kufar.com"},
+			expected: "kufar.com:203.0.113.7",
+			found:    true,
+		},
+		{
+			name: "fallback chain",
+			cfg: KeyConfig{Sources: []KeySource{
+				{Type: HeaderKeySource, Name: "X-Api-Key"},
+				{Type: CompositeKeySource, Parts: []KeySource{{Type: ClaimKeySource, Name: "iss"}, {Type: IPKeySource}}},
+				{Type: QueryKeySource, Name: "api_key"},
+			}},
+			url:      "/items/42?api_key=secret",
+			headers:  map[string]string{"Authorization": "Bearer not-a-token"},
+			expected: "secret",
+			found:    true,
+		},
+		{
+			name:     "missing shared",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-Api-Key"}}},
+			expected: AnonymousKey,
+			found:    true,
+		},
+		{
+			name:     "missing ip",
+			cfg:      KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-Api-Key"}}, Missing: MissingKeyIP},
+			expected: "203.0.113.7",
+			found:    true,
+		},
+		{
+			name:  "missing reject",
+			cfg:   KeyConfig{Sources: []KeySource{{Type: CookieKeySource, Name: "session"}}, Missing: MissingKeyReject},
+			found: false,
+		},
+	}
+
+	jwt, _ := NewJWTVerifier(JWTConfig{Unverified: true})
+	for _, c := range checks {
+		b, err := NewKeyBuilder(c.cfg, nil, jwt)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		url := c.url
+		if url == "" {
+			url = "/items/42"
+		}
+		var key string
+		var found bool
+		engine := gin.New()
+		engine.GET("/items/:id", func(ctx *gin.Context) {
+			for k, v := range c.context {
+				ctx.Set(k, v)
+			}
+			key, found = b.Key(ctx)
+		})
+		req, _ := http.NewRequest("GET", url, nil)
+		req.RemoteAddr = "203.0.113.7:5000"
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+
+		if found != c.found {
+			t.Errorf("%s: unexpected found value (expected: %t, got: %t)", c.name, c.found, found)
+		}
+		if key != c.expected {
+			t.Errorf("%s: unexpected key (expected: %s, got: %s)", c.name, c.expected, key)
+		}
+	}
+}
+
+func TestNewKeyBuilderErrors(t *testing.T) {
+	for _, cfg := range []KeyConfig{
+		{Sources: []KeySource{{Type: "body"}}},
+		{Sources: []KeySource{{Type: CompositeKeySource, Parts: []KeySource{{Type: CompositeKeySource}}}}},
+		// claims without a jwt verifier
+		{Sources: []KeySource{{Type: ClaimKeySource, Name: "iss"}}},
+		{Sources: []KeySource{{Type: CompositeKeySource, Parts: []KeySource{{Type: ClaimKeySource, Name: "iss"}, {Type: IPKeySource}}}}},
+	} {
+		if _, err := NewKeyBuilder(cfg, nil, nil); err == nil {
+			t.Errorf("An error is expected for %+v", cfg)
+		}
+	}
+}
+
+func TestGinRateLimiterMissingKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := RateLimitConfig{Key: KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-Api-Key"}}, Missing: MissingKeyReject}}
+	// the mock fails for every request, so only the rejected ones are not 500
+	rl, err := NewGinRateLimiter(&mockRateLimiter{}, IpVaryBy(), cfg, logging.NoOp)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	engine := gin.New()
+	engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	for header, expected := range map[string]int{"": http.StatusUnauthorized, "secret": http.StatusInternalServerError} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		if header != "" {
+			req.Header.Set("X-Api-Key", header)
+		}
+		engine.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Unexpected status for key %q (expected: %d, got: %d)", header, expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/devopsfaith/krakend/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// File holding the namespace of the running pod
+const kubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// NewKubernetesClient builds a kubernetes client using the service account of the running pod
+func NewKubernetesClient() (kubernetes.Interface, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+// Node counter for kubernetes. It counts the ready endpoints of cfg.Service or, if no
+// service is set, the ready pods matching cfg.LabelSelector
+func NewKubernetesNodeCounter(client kubernetes.Interface, cfg NodeCounterConfig, logger logging.Logger) NodeCounter {
+	return newKubernetesNodes(client, cfg, logger).Count
+}
+
+// The nodes are identified by their pod name, which is the hostname of the running pod
+func newKubernetesNodes(client kubernetes.Interface, cfg NodeCounterConfig, logger logging.Logger) *lastKnownNodes {
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = currentKubernetesNamespace()
+	}
+	timeout := nodeCounterTimeout(cfg)
+
+	return newLastKnownNodes(KubernetesNodeCounter, cfg, hostname(), func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if cfg.Service != "" {
+			return listReadyEndpoints(ctx, client, namespace, cfg.Service)
+		}
+		return listReadyPods(ctx, client, namespace, cfg.LabelSelector)
+	}, logger)
+}
+
+// listReadyEndpoints lists the ready endpoints in every EndpointSlice of the service.
+// Dual-stack services have a slice per address family, so endpoints are listed once per pod
+func listReadyEndpoints(ctx context.Context, client kubernetes.Interface, namespace, service string) ([]string, error) {
+	slices, err := client.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + service,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ready := map[string]struct{}{}
+	for _, slice := range slices.Items {
+		for _, e := range slice.Endpoints {
+			// a nil ready condition must be interpreted as ready
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			if e.TargetRef != nil && e.TargetRef.Name != "" {
+				ready[e.TargetRef.Name] = struct{}{}
+			} else if len(e.Addresses) > 0 {
+				ready[e.Addresses[0]] = struct{}{}
+			}
+		}
+	}
+	return setKeys(ready), nil
+}
+
+// listReadyPods lists the running pods matching the selector that are ready and not being deleted
+func listReadyPods(ctx context.Context, client kubernetes.Interface, namespace, selector string) ([]string, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	ready := []string{}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		for _, c := range pod.Status.Conditions {
+			if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+				ready = append(ready, pod.Name)
+				break
+			}
+		}
+	}
+	return ready, nil
+}
+
+func currentKubernetesNamespace() string {
+	ns, err := ioutil.ReadFile(kubernetesNamespaceFile)
+	if err != nil {
+		return metav1.NamespaceDefault
+	}
+	return strings.TrimSpace(string(ns))
+}
@@ -0,0 +1,134 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestKubernetesNodeCounterEndpointSlices(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	ready, notReady := true, false
+	endpoint := func(uid string, address string, ready *bool) discoveryv1.Endpoint {
+		e := discoveryv1.Endpoint{Addresses: []string{address}, Conditions: discoveryv1.EndpointConditions{Ready: ready}}
+		if uid != "" {
+			e.TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: uid, UID: types.UID(uid)}
+		}
+		return e
+	}
+	slice := func(name, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "gateway",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+			},
+			Endpoints: endpoints,
+		}
+	}
+	client := fake.NewSimpleClientset(
+		slice("krakend-ipv4", "krakend",
+			endpoint("pod-1", "10.0.0.1", &ready),
+			endpoint("pod-2", "10.0.0.2", nil),
+			endpoint("pod-3", "10.0.0.3", &notReady),
+			endpoint("", "10.0.0.4", &ready),
+		),
+		// the same pods in the IPv6 slice must not be counted twice
+		slice("krakend-ipv6", "krakend",
+			endpoint("pod-1", "fd00::1", &ready),
+			endpoint("pod-2", "fd00::2", &ready),
+		),
+		slice("other", "other", endpoint("pod-9", "10.0.0.9", &ready)),
+	)
+
+	nodeCounter := NewKubernetesNodeCounter(client, NodeCounterConfig{Namespace: "gateway", Service: "krakend"}, logger)
+	if n := nodeCounter(); n != 3 {
+		t.Errorf("Unexpected node count (expected: 3, got: %d)", n)
+	}
+}
+
+func TestKubernetesNodeCounterPods(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	now := metav1.NewTime(time.Now())
+	pod := func(name string, labels map[string]string, phase corev1.PodPhase, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "gateway", Labels: labels},
+			Status: corev1.PodStatus{
+				Phase:      phase,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			},
+		}
+	}
+	krakend := map[string]string{"app": "krakend"}
+	terminating := pod("krakend-4", krakend, corev1.PodRunning, corev1.ConditionTrue)
+	terminating.DeletionTimestamp = &now
+	client := fake.NewSimpleClientset(
+		pod("krakend-1", krakend, corev1.PodRunning, corev1.ConditionTrue),
+		pod("krakend-2", krakend, corev1.PodRunning, corev1.ConditionTrue),
+		pod("krakend-3", krakend, corev1.PodRunning, corev1.ConditionFalse),
+		pod("krakend-5", krakend, corev1.PodPending, corev1.ConditionFalse),
+		pod("backend-1", map[string]string{"app": "backend"}, corev1.PodRunning, corev1.ConditionTrue),
+		terminating,
+	)
+
+	nodeCounter := NewKubernetesNodeCounter(client, NodeCounterConfig{Namespace: "gateway", LabelSelector: "app=krakend"}, logger)
+	if n := nodeCounter(); n != 2 {
+		t.Errorf("Unexpected node count (expected: 2, got: %d)", n)
+	}
+}
+
+func TestKubernetesNodeCounterFallback(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "krakend-1", Namespace: "gateway", Labels: map[string]string{"app": "krakend"}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	})
+	failing := false
+	client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		return false, nil, nil
+	})
+
+	cfg := NodeCounterConfig{Namespace: "gateway", LabelSelector: "app=krakend", Fallback: 4}
+	nodeCounter := NewKubernetesNodeCounter(client, cfg, logger)
+
+	failing = true
+	if n := nodeCounter(); n != 4 {
+		t.Errorf("Unexpected node count before the first count (expected: 4, got: %d)", n)
+	}
+	failing = false
+	if n := nodeCounter(); n != 1 {
+		t.Errorf("Unexpected node count (expected: 1, got: %d)", n)
+	}
+	failing = true
+	if n := nodeCounter(); n != 1 {
+		t.Errorf("Unexpected last known node count (expected: 1, got: %d)", n)
+	}
+
+	// no ready pods found: the last known count is kept
+	failing = false
+	nodeCounter = NewKubernetesNodeCounter(client, NodeCounterConfig{Namespace: "gateway", LabelSelector: "app=none"}, logger)
+	if n := nodeCounter(); n != 1 {
+		t.Errorf("Unexpected node count without pods (expected: 1, got: %d)", n)
+	}
+}
@@ -0,0 +1,241 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+const defaultNodeCounterTimeout = 5 * time.Second
+
+// NodeIndex returns the position (0 based) of the running node among the sorted ids of the
+// counted nodes, or -1 if it is unknown. The position is only known if the nodes listed by the
+// last count are as many as nodes, the node count applied by the caller, so the index and the
+// count always come from the same list
+type NodeIndex func(nodes int) int
+
+// NewNodeCounter builds the NodeCounter selected in the config, damped with DampedNodeCounter
+// and cached for the poll interval with CachedNodeCounter
+func NewNodeCounter(cfg NodeCounterConfig, logger logging.Logger) (NodeCounter, error) {
+	nodeCounter, _, err := NewIndexedNodeCounter(cfg, logger)
+	return nodeCounter, err
+}
+
+// NewIndexedNodeCounter works like NewNodeCounter, and also returns the NodeIndex of the running
+// node in the last count. The running node id is cfg.NodeID or, if not set, the instance id (aws),
+// the task ARN (ecs) or the hostname.
+// While the damped count (see DampedNodeCounter) is not the number of listed nodes, the index is
+// unknown
+func NewIndexedNodeCounter(cfg NodeCounterConfig, logger logging.Logger) (NodeCounter, NodeIndex, error) {
+	var nodes *lastKnownNodes
+	var err error
+	switch cfg.Type {
+	case "":
+		return pollNodeCounter(DefaultNodeCounter(), cfg), singleNodeIndex, nil
+	case KubernetesNodeCounter:
+		client, err := NewKubernetesClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		nodes = newKubernetesNodes(client, cfg, logger)
+	case DNSNodeCounter:
+		nodes = newDNSNodes(cfg, logger)
+	case ConsulNodeCounter:
+		nodes = newConsulNodes(&http.Client{}, cfg, logger)
+	case AwsNodeCounter:
+		nodes, err = newAwsNodesFromMetadata(cfg, logger)
+	case EcsNodeCounter:
+		nodes, err = newEcsNodesFromMetadata(cfg, logger)
+	default:
+		err = fmt.Errorf("unknown node counter type '%s'", cfg.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return pollNodeCounter(nodes.Count, cfg), nodes.Index, nil
+}
+
+// pollNodeCounter damps nodeCounter and caches the damped count, so the damping state is kept
+// per poll and not per updater
+func pollNodeCounter(nodeCounter NodeCounter, cfg NodeCounterConfig) NodeCounter {
+	interval := cfg.PollInterval
+	if interval <= 0 {
+		interval = rateLimiterUpdateRate
+	}
+	return CachedNodeCounter(DampedNodeCounter(nodeCounter, cfg), interval)
+}
+
+// CachedNodeCounter wraps nodeCounter, so every call during half the interval after a count gets
+// that count. The updaters of the service, endpoint and backend rate limiters ticking every interval
+// share a single count, while an updater ticking a bit early still counts again on every tick
+func CachedNodeCounter(nodeCounter NodeCounter, interval time.Duration) NodeCounter {
+	return cachedNodeCounter(nodeCounter, interval, time.Now)
+}
+
+func cachedNodeCounter(nodeCounter NodeCounter, interval time.Duration, now func() time.Time) NodeCounter {
+	var mu sync.Mutex
+	count := 0
+	var counted time.Time
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		t := now()
+		if counted.IsZero() || t.Sub(counted) >= interval/2 {
+			count, counted = nodeCounter(), t
+		}
+		return count
+	}
+}
+
+// DampedNodeCounter wraps nodeCounter, so its counts are kept between cfg.MinNodes (at least 1)
+// and cfg.MaxNodes. A count higher than the current one lowers the per node limits, so it is
+// applied right away. A lower count is only applied once it has been returned by cfg.StablePolls
+// consecutive calls over cfg.StableFor at least, so deploys do not rebuild the limiters on every poll
+func DampedNodeCounter(nodeCounter NodeCounter, cfg NodeCounterConfig) NodeCounter {
+	return dampedNodeCounter(nodeCounter, cfg, time.Now)
+}
+
+func dampedNodeCounter(nodeCounter NodeCounter, cfg NodeCounterConfig, now func() time.Time) NodeCounter {
+	minNodes := cfg.MinNodes
+	if minNodes < 1 {
+		minNodes = 1
+	}
+	var mu sync.Mutex
+	current, candidate, polls := 0, 0, 0
+	var since time.Time
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		n := nodeCounter()
+		if n < minNodes {
+			n = minNodes
+		}
+		if cfg.MaxNodes > 0 && n > cfg.MaxNodes {
+			n = cfg.MaxNodes
+		}
+		if current == 0 || n >= current {
+			current, candidate = n, 0
+			return current
+		}
+
+		t := now()
+		if n != candidate {
+			candidate, polls, since = n, 0, t
+		}
+		polls++
+		if polls >= cfg.StablePolls && t.Sub(since) >= cfg.StableFor {
+			current, candidate = n, 0
+		}
+		return current
+	}
+}
+
+// singleNodeIndex is the NodeIndex of the DefaultNodeCounter
+func singleNodeIndex(nodes int) int {
+	if nodes != 1 {
+		return -1
+	}
+	return 0
+}
+
+// lastKnownNodes keeps the ids of the nodes found by the last successful list, so the last
+// known count is used when list fails or finds no nodes at all (the running node is always
+// there). Until the first successful list, the fallback count is used
+type lastKnownNodes struct {
+	mu       sync.Mutex
+	name     string
+	fallback int
+	self     string
+	list     func() ([]string, error)
+	logger   logging.Logger
+	ids      []string // sorted, nil until the first successful list
+}
+
+// newLastKnownNodes builds a lastKnownNodes for list, which must return distinct ids. self is
+// the id of the running node, unless cfg.NodeID is set
+func newLastKnownNodes(name string, cfg NodeCounterConfig, self string, list func() ([]string, error),
+	logger logging.Logger) *lastKnownNodes {
+	fallback := cfg.Fallback
+	if fallback < 1 {
+		fallback = 1
+	}
+	if cfg.NodeID != "" {
+		self = cfg.NodeID
+	}
+	return &lastKnownNodes{name: name, fallback: fallback, self: self, list: list, logger: logger}
+}
+
+// Count lists the nodes and returns how many they are
+func (n *lastKnownNodes) Count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ids, err := n.list()
+	if err != nil {
+		n.logger.Warning("Unable to count the", n.name, "nodes, keeping", n.count(), ":", err.Error())
+		return n.count()
+	}
+	if len(ids) == 0 {
+		n.logger.Warning("No", n.name, "nodes found, keeping", n.count())
+		return n.count()
+	}
+	sort.Strings(ids)
+	n.ids = ids
+	n.logger.Debug(n.name, "nodes:", len(ids))
+	return len(ids)
+}
+
+// Index returns the position of the running node in the last successful list, or -1 if it
+// was not there or the list does not have the given number of nodes
+func (n *lastKnownNodes) Index(nodes int) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.ids) != nodes {
+		return -1
+	}
+	i := sort.SearchStrings(n.ids, n.self)
+	if n.self == "" || i == len(n.ids) || n.ids[i] != n.self {
+		return -1
+	}
+	return i
+}
+
+func (n *lastKnownNodes) count() int {
+	if n.ids == nil {
+		return n.fallback
+	}
+	return len(n.ids)
+}
+
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+func nodeCounterTimeout(cfg NodeCounterConfig) time.Duration {
+	if cfg.Timeout <= 0 {
+		return defaultNodeCounterTimeout
+	}
+	return cfg.Timeout
+}
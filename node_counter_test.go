@@ -0,0 +1,181 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestDampedNodeCounter(t *testing.T) {
+	start := time.Now()
+	clock := start
+	count := 0
+	nodeCounter := dampedNodeCounter(func() int { return count }, NodeCounterConfig{
+		MinNodes:    2,
+		MaxNodes:    10,
+		StablePolls: 3,
+		StableFor:   20 * time.Second,
+	}, func() time.Time { return clock })
+
+	checks := []struct {
+		name     string
+		count    int
+		elapsed  time.Duration
+		expected int
+	}{
+		{name: "min bound", count: 0, expected: 2},
+		{name: "scale up", count: 4, expected: 4},
+		{name: "max bound", count: 15, expected: 10},
+		{name: "scale down 1st poll", count: 6, elapsed: 10 * time.Second, expected: 10},
+		{name: "scale down 2nd poll", count: 6, elapsed: 20 * time.Second, expected: 10},
+		{name: "scale down 3rd poll", count: 6, elapsed: 30 * time.Second, expected: 6},
+		{name: "flapping 1st poll", count: 5, elapsed: 40 * time.Second, expected: 6},
+		{name: "flapping 2nd poll", count: 4, elapsed: 50 * time.Second, expected: 6},
+		{name: "flapping 3rd poll", count: 5, elapsed: 60 * time.Second, expected: 6},
+		{name: "flapping scale up", count: 7, elapsed: 70 * time.Second, expected: 7},
+		{name: "stable polls but not for long", count: 3, elapsed: 71 * time.Second, expected: 7},
+		{name: "stable polls but not for long", count: 3, elapsed: 72 * time.Second, expected: 7},
+		{name: "stable polls but not for long", count: 3, elapsed: 73 * time.Second, expected: 7},
+		{name: "stable polls for long", count: 3, elapsed: 91 * time.Second, expected: 3},
+	}
+	for _, c := range checks {
+		count = c.count
+		clock = start.Add(c.elapsed)
+		if n := nodeCounter(); n != c.expected {
+			t.Errorf("%s: unexpected node count (expected: %d, got: %d)", c.name, c.expected, n)
+		}
+	}
+}
+
+func TestCachedNodeCounter(t *testing.T) {
+	start := time.Now()
+	clock := start
+	count, polls := 4, 0
+	nodeCounter := cachedNodeCounter(func() int {
+		polls++
+		return count
+	}, 10*time.Second, func() time.Time { return clock })
+
+	checks := []struct {
+		count    int
+		elapsed  time.Duration
+		expected int
+		polls    int
+	}{
+		{count: 4, expected: 4, polls: 1},
+		{count: 5, elapsed: 3 * time.Second, expected: 4, polls: 1},
+		{count: 5, elapsed: 6 * time.Second, expected: 5, polls: 2},
+		{count: 6, elapsed: 9 * time.Second, expected: 5, polls: 2},
+		// a tick a bit early still counts again
+		{count: 6, elapsed: 15*time.Second + time.Millisecond, expected: 6, polls: 3},
+	}
+	for i, c := range checks {
+		count = c.count
+		clock = start.Add(c.elapsed)
+		if n := nodeCounter(); n != c.expected || polls != c.polls {
+			t.Errorf("Unexpected node count %d (expected: %d after %d polls, got: %d after %d polls)", i, c.expected, c.polls, n, polls)
+		}
+	}
+}
+
+func TestPollNodeCounterSharedDamping(t *testing.T) {
+	start := time.Now()
+	clock := start
+	count := 4
+	cfg := NodeCounterConfig{StablePolls: 3}
+	nodeCounter := cachedNodeCounter(dampedNodeCounter(func() int { return count }, cfg, func() time.Time { return clock }),
+		10*time.Second, func() time.Time { return clock })
+
+	nodeCounter()
+	count = 2
+	// three updaters share the node counter, so every tick is a single poll of the damped count
+	for tick := 1; tick <= 3; tick++ {
+		expected := 4
+		if tick == 3 {
+			expected = 2
+		}
+		for updater := 0; updater < 3; updater++ {
+			clock = start.Add(time.Duration(tick)*10*time.Second + time.Duration(updater)*time.Second)
+			if n := nodeCounter(); n != expected {
+				t.Errorf("Unexpected node count of updater %d on tick %d (expected: %d, got: %d)", updater, tick, expected, n)
+			}
+		}
+	}
+}
+
+func TestDampedNodeCounterDefaults(t *testing.T) {
+	count := 3
+	nodeCounter := DampedNodeCounter(func() int { return count }, NodeCounterConfig{})
+	for _, c := range []struct{ count, expected int }{{3, 3}, {1, 1}, {0, 1}, {-2, 1}, {5, 5}} {
+		count = c.count
+		if n := nodeCounter(); n != c.expected {
+			t.Errorf("Unexpected node count for %d (expected: %d, got: %d)", c.count, c.expected, n)
+		}
+	}
+}
+
+func TestExactNodeSplit(t *testing.T) {
+	checks := []struct {
+		clusterValue int
+		nodes        int
+		expected     []int
+	}{
+		{clusterValue: 10, nodes: 4, expected: []int{3, 3, 2, 2}},
+		{clusterValue: 12, nodes: 4, expected: []int{3, 3, 3, 3}},
+		{clusterValue: 3, nodes: 5, expected: []int{1, 1, 1, 0, 0}},
+		{clusterValue: 7, nodes: 0, expected: []int{7}},
+	}
+	for _, c := range checks {
+		sum := 0
+		for i, expected := range c.expected {
+			index := i
+			v := ExactNodeSplit(func(int) int { return index })(c.clusterValue, c.nodes)
+			if v != expected {
+				t.Errorf("Unexpected value for node %d of %d (expected: %d, got: %d)", i, c.nodes, expected, v)
+			}
+			sum += v
+		}
+		if sum != c.clusterValue {
+			t.Errorf("Unexpected sum for %d nodes (expected: %d, got: %d)", c.nodes, c.clusterValue, sum)
+		}
+	}
+
+	if v := ExactNodeSplit(func(int) int { return -1 })(10, 4); v != 2 {
+		t.Errorf("Unexpected value for an unknown node (expected: 2, got: %d)", v)
+	}
+}
+
+func TestLastKnownNodesIndex(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	ids := []string{"krakend-c", "krakend-a", "krakend-b"}
+	nodes := newLastKnownNodes("test", NodeCounterConfig{}, "krakend-b", func() ([]string, error) { return ids, nil }, logger)
+	if i := nodes.Index(1); i != -1 {
+		t.Errorf("Unexpected index before the first count (expected: -1, got: %d)", i)
+	}
+	nodes.Count()
+	if i := nodes.Index(3); i != 1 {
+		t.Errorf("Unexpected index (expected: 1, got: %d)", i)
+	}
+	// a damped count not matching the listed nodes
+	if i := nodes.Index(4); i != -1 {
+		t.Errorf("Unexpected index of another count (expected: -1, got: %d)", i)
+	}
+
+	nodes = newLastKnownNodes("test", NodeCounterConfig{NodeID: "krakend-c"}, "krakend-b", func() ([]string, error) { return ids, nil }, logger)
+	nodes.Count()
+	if i := nodes.Index(3); i != 2 {
+		t.Errorf("Unexpected index of the configured node id (expected: 2, got: %d)", i)
+	}
+}
+
+func TestValuePerNodeWithoutNodes(t *testing.T) {
+	if v := valuePerNode(10, 0); v != 10 {
+		t.Errorf("Unexpected value per node (expected: 10, got: %d)", v)
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/throttled/throttled"
+)
+
+// BackendLimitedError is returned by the backend rate limit middleware when a request
+// to the backend is denied
+type BackendLimitedError struct {
+	Backend    string
+	Key        string
+	StatusCode int
+	Result     throttled.RateLimitResult
+}
+
+func (e *BackendLimitedError) Error() string {
+	return fmt.Sprintf("ratelimit: backend %s limit exceeded for key '%s'", e.Backend, e.Key)
+}
+
+// ToHTTPError translates a BackendLimitedError into its configured status code
+// (429 by default). Any other error is an internal server error. It can be used with
+// kgin.CustomErrorEndpointHandler
+func ToHTTPError(err error) int {
+	if e, ok := err.(*BackendLimitedError); ok {
+		return e.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// BackendFactory wraps a proxy.BackendFactory, adding the backend rate limit middleware to
+// every backend declaring the Namespace block in its extra_config. The updaters of the rate
+// limiters stop when ctx is done, so cancel it when the proxies are rebuilt (e.g. on reloads)
+func BackendFactory(ctx context.Context, next proxy.BackendFactory, nodeCounter NodeCounter, logger logging.Logger) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		return NewBackendMiddleware(ctx, remote, nodeCounter, logger)(next(remote))
+	}
+}
+
+// NewBackendMiddleware builds a cluster aware rate limit proxy.Middleware for the given backend.
+// If the backend has no Namespace block, the middleware does nothing. An invalid config is fatal,
+// so a misconfigured backend never runs without its limits. The updater of the rate limiter stops
+// when ctx is done
+func NewBackendMiddleware(ctx context.Context, remote *config.Backend, nodeCounter NodeCounter, logger logging.Logger) proxy.Middleware {
+	cfg, err := ParseBackendConfig(remote.ExtraConfig)
+	if err == ErrNoConfig {
+		return proxy.EmptyMiddleware
+	}
+	var rateLimiter UpdatableClusterRateLimiter
+	if err == nil {
+		rateLimiter, err = newBackendRateLimiter(remote, cfg, nodeCounter)
+	}
+	if err != nil {
+		logger.Fatal("Unable to build RateLimit for backend", remote.URLPattern, ":", err.Error())
+		return proxy.EmptyMiddleware
+	}
+	StartUpdater(ctx, rateLimiter, updateInterval(cfg.UpdateInterval), nodeCounter, logger, UpdaterHooks{})
+	logger.Info("Starting backend RateLimit for", remote.URLPattern)
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			var key string
+			if cfg.PerHost && r.URL != nil {
+				key = r.URL.Host
+			}
+
+			limited, result, err := rateLimiter.RateLimit(key, 1)
+			if err != nil {
+				return nil, err
+			}
+			if limited {
+				return nil, &BackendLimitedError{
+					Backend:    remote.URLPattern,
+					Key:        key,
+					StatusCode: cfg.StatusCode,
+					Result:     result,
+				}
+			}
+			return next[0](ctx, r)
+		}
+	}
+}
+
+func newBackendRateLimiter(remote *config.Backend, cfg BackendRateLimitConfig, nodeCounter NodeCounter) (UpdatableClusterRateLimiter, error) {
+	cfg.Store.KeyPrefix += backendKeyPrefix(remote)
+	factory, err := NewRateLimiterFactory(cfg.Store)
+	if err != nil {
+		return nil, err
+	}
+	return NewWindowsRateLimiter(factory, nodeCounter(), getRLWindows(cfg.RateLimitSettings))
+}
+
+// backendKeyPrefix keeps the backend buckets apart from the endpoint ones and from the
+// backends with the same url pattern in other hosts in shared stores
+func backendKeyPrefix(remote *config.Backend) string {
+	return remote.Method + strings.Join(remote.Host, ",") + remote.URLPattern + ":"
+}
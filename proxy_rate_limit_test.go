@@ -0,0 +1,173 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestParseBackendConfig(t *testing.T) {
+	extra := parseExtraConfig(t, `{
+		"github.com/schibsted/krakend-ratelimit": {"max_requests": 10, "burst_size": 2, "per_host": true, "status_code": 503}
+	}`)
+	cfg, err := ParseBackendConfig(extra)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := BackendRateLimitConfig{
+		RateLimitSettings: RateLimitSettings{MaxRequests: 10, BurstSize: 2},
+		PerHost:           true,
+		StatusCode:        http.StatusServiceUnavailable,
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Unexpected config (expected: %+v, got: %+v)", expected, cfg)
+	}
+
+	extra = parseExtraConfig(t, `{"github.com/schibsted/krakend-ratelimit": {"max_requests": 10, "status_code": 200}}`)
+	if _, err := ParseBackendConfig(extra); err == nil {
+		t.Errorf("A non error status code should be rejected")
+	}
+
+	extra = parseExtraConfig(t, `{"github.com/schibsted/krakend-ratelimit": {"max_requests": 10, "sub_limit": {"fraction": 0.5}}}`)
+	if _, err := ParseBackendConfig(extra); err == nil {
+		t.Errorf("A sub limit should be rejected in the backends")
+	}
+}
+
+func TestBackendKeyPrefix(t *testing.T) {
+	checks := []struct {
+		remote   *config.Backend
+		expected string
+	}{
+		{
+			remote:   &config.Backend{URLPattern: "/hello"},
+			expected: "/hello:",
+		},
+		{
+			remote:   &config.Backend{Method: "GET", Host: []string{"http://backend-1:8000"}, URLPattern: "/hello"},
+			expected: "GEThttp://backend-1:8000/hello:",
+		},
+		{
+			remote:   &config.Backend{Method: "GET", Host: []string{"http://backend-1:8000", "http://backend-2:8000"}, URLPattern: "/hello"},
+			expected: "GEThttp://backend-1:8000,http://backend-2:8000/hello:",
+		},
+	}
+	for _, c := range checks {
+		if got := backendKeyPrefix(c.remote); got != c.expected {
+			t.Errorf("Unexpected key prefix (expected: %s, got: %s)", c.expected, got)
+		}
+	}
+}
+
+func TestBackendMiddleware(t *testing.T) {
+	logger, _ := logging.NewLogger("ERROR", os.Stdout, "[KRAKEND]")
+	backendErr := errors.New("backend error")
+	next := func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		if r.URL.Host == "broken" {
+			return nil, backendErr
+		}
+		return &proxy.Response{IsComplete: true}, nil
+	}
+
+	checks := []struct {
+		name     string
+		raw      string
+		hosts    []string
+		expected []int
+	}{
+		{
+			name:     "no config",
+			raw:      `{}`,
+			hosts:    []string{"a", "a", "a"},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:     "shared bucket",
+			raw:      `{"github.com/schibsted/krakend-ratelimit": {"max_requests": 1}}`,
+			hosts:    []string{"a", "b", "a"},
+			expected: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name:     "per host",
+			raw:      `{"github.com/schibsted/krakend-ratelimit": {"max_requests": 1, "per_host": true, "status_code": 503}}`,
+			hosts:    []string{"a", "b", "a", "broken"},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable, http.StatusInternalServerError},
+		},
+	}
+
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			remote := &config.Backend{URLPattern: "/hello", ExtraConfig: parseExtraConfig(t, c.raw)}
+			p := BackendFactory(context.Background(), func(_ *config.Backend) proxy.Proxy { return next }, DefaultNodeCounter(), logger)(remote)
+
+			for i, host := range c.hosts {
+				_, err := p(context.Background(), &proxy.Request{URL: &url.URL{Host: host}})
+				status := http.StatusOK
+				if err != nil {
+					status = ToHTTPError(err)
+				}
+				if status != c.expected[i] {
+					t.Errorf("Unexpected status for request %d to %s (expected: %d, got: %d)", i, host, c.expected[i], status)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendFactoryStopsUpdaters(t *testing.T) {
+	logger, _ := logging.NewLogger("ERROR", os.Stdout, "[KRAKEND]")
+	remote := &config.Backend{URLPattern: "/hello", ExtraConfig: parseExtraConfig(t, `{
+		"github.com/schibsted/krakend-ratelimit": {"max_requests": 1}
+	}`)}
+	next := func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) { return &proxy.Response{}, nil }
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	// every reload builds the backend proxies again
+	for i := 0; i < 10; i++ {
+		BackendFactory(ctx, next, DefaultNodeCounter(), logger)(remote)
+	}
+	if n := runtime.NumGoroutine(); n < before+10 {
+		t.Errorf("Unexpected goroutines before cancelling (expected: at least %d, got: %d)", before+10, n)
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("The updaters must stop with the context (expected: %d goroutines, got: %d)", before, n)
+	}
+}
+
+func TestBackendFactoryInvalidConfig(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	next := func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) { return &proxy.Response{}, nil }
+	}
+	for _, raw := range []string{
+		`{"github.com/schibsted/krakend-ratelimit": {"max_requests": 10, "status_code": 200}}`,
+		`{"github.com/schibsted/krakend-ratelimit": {"max_requests": 10, "store": {"type": "redis"}}}`,
+	} {
+		remote := &config.Backend{URLPattern: "/hello", ExtraConfig: parseExtraConfig(t, raw)}
+		assertFatal(t, raw, func() { BackendFactory(context.Background(), next, DefaultNodeCounter(), fatalLogger{logger})(remote) })
+	}
+}
@@ -6,11 +6,13 @@
 package ratelimit
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/devopsfaith/krakend/logging"
 	"github.com/throttled/throttled"
-	"github.com/throttled/throttled/store/memstore"
 )
 
 type NodeCounter func() int
@@ -22,60 +24,203 @@ func DefaultNodeCounter() NodeCounter {
 }
 
 func BuildRateLimiter(c RateLimitConfig, nodes NodeCounter, logger logging.Logger) UpdatableClusterRateLimiter {
-	factory := InMemoryGCRARateLimiterFactory{}
+	return BuildIndexedRateLimiter(c, nodes, nil, logger)
+}
+
+// BuildIndexedRateLimiter works like BuildRateLimiter. The index of the running node is
+// required to split the limits with ExactSplit (see NewIndexedNodeCounter)
+func BuildIndexedRateLimiter(c RateLimitConfig, nodes NodeCounter, index NodeIndex, logger logging.Logger) UpdatableClusterRateLimiter {
+	if c.SubLimit.enabled() {
+		parent := c
+		parent.SubLimit = SubLimitConfig{}
+		logger.Info("Starting RateLimit sub limits")
+		return NewHierarchicalRateLimiter(BuildIndexedRateLimiter(parent, nodes, index, logger),
+			BuildIndexedRateLimiter(subLimitConfig(c), nodes, index, logger))
+	}
+	factory, err := NewRateLimiterFactory(c.Store)
+	if err != nil {
+		logger.Fatal("ERROR:", err.Error())
+	}
+	if c.Split == ExactSplit {
+		if index == nil {
+			logger.Warning("RateLimit exact split requires the node index, rounding up the limits per node")
+		} else {
+			factory = WithNodeSplit(factory, ExactNodeSplit(index))
+		}
+	}
 
-	defaultSettings := getRLSettings(c.Default)
-	customSettings := make(map[string]RateLimiterSettings)
+	defaultWindows := getRLWindows(c.Default)
+	customWindows := make(map[string][]RateLimiterSettings)
 	for k, v := range c.Custom {
-		s := getRLSettings(v)
-		customSettings[k] = s
-		logger.Info("Starting RateLimit with reqsMin:", s.reqsMinute, " and burstSize:", s.burstSize)
+		windows := getRLWindows(v)
+		customWindows[k] = windows
+		for _, s := range windows {
+			logger.Info("Starting RateLimit with maxRequests:", s.maxRequests, " per", s.period, " and burstSize:", s.burstSize)
+		}
 	}
 
-	rateLimiter, err := NewMultiRateLimiter(factory, nodes(), defaultSettings, customSettings)
+	plans := getRLPlans(c)
+	for name, windows := range plans {
+		for _, s := range windows {
+			logger.Info("Starting RateLimit plan", name, "with maxRequests:", s.maxRequests, " per", s.period, " and burstSize:", s.burstSize)
+		}
+	}
+	tenants, err := LoadTenants(c)
 	if err != nil {
 		logger.Fatal("ERROR:", err.Error())
 	}
+
+	rateLimiter, err := NewMultiRateLimiterWithPlans(factory, nodes(), defaultWindows, customWindows, plans, tenants)
+	if err != nil {
+		logger.Fatal("ERROR:", err.Error())
+	}
+	// only shared stores can fail, so the in-memory one never needs a fallback
+	if c.FailurePolicy == FailLocal && isClusterWide(factory) {
+		local := c
+		local.Store = StoreConfig{Type: MemoryStore}
+		local.FailurePolicy = FailClosed
+		logger.Info("Starting local fallback RateLimit")
+		return NewFallbackRateLimiter(rateLimiter, BuildIndexedRateLimiter(local, nodes, index, logger))
+	}
 	return rateLimiter
 }
 
-// Update internal GinRateLimit settings depending on service configuration on ApiGW nodes amount
+// Update internal GinRateLimit settings depending on service configuration on ApiGW nodes amount.
+// It never returns; use StartUpdater to get an updater that can be stopped
 func RateLimitUpdater(rateLimiter UpdatableClusterRateLimiter, interval time.Duration, nodeCounter NodeCounter, logger logging.Logger) {
-	for {
-		time.Sleep(interval)
-		nodeCount := nodeCounter()
-		if nodeCount != rateLimiter.Nodes() {
-			logger.Info("Updating RateLimit node count", nodeCount)
-			rateLimiter.UpdateNodeCount(nodeCount)
-		}
+	<-StartUpdater(context.Background(), rateLimiter, interval, nodeCounter, logger, UpdaterHooks{}).Done()
+}
+
+// updateInterval returns the configured interval or the default one
+func updateInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return rateLimiterUpdateRate
 	}
+	return interval
 }
 
 func getRLSettings(s RateLimitSettings) RateLimiterSettings {
+	period := s.Period
+	if period <= 0 {
+		period = time.Minute
+	}
 	return RateLimiterSettings{
-		reqsMinute: s.MaxRequests,
-		burstSize:  s.BurstSize,
+		maxRequests: s.MaxRequests,
+		period:      period,
+		burstSize:   s.BurstSize,
 	}
 }
 
+func getRLWindows(s RateLimitSettings) []RateLimiterSettings {
+	if len(s.Windows) == 0 {
+		return []RateLimiterSettings{getRLSettings(s)}
+	}
+	windows := make([]RateLimiterSettings, len(s.Windows))
+	for i, w := range s.Windows {
+		windows[i] = getRLSettings(w)
+	}
+	return windows
+}
+
 type RateLimiterFactory interface {
-	Build(reqsMinute int, burstSize int) (throttled.RateLimiter, error)
+	Build(maxRequests int, period time.Duration, burstSize int) (throttled.RateLimiter, error)
 }
 
-type InMemoryGCRARateLimiterFactory struct{}
+// ClusterWideRateLimiterFactory is implemented by the factories building rate limiters
+// whose state is shared by every node, so their settings must not be divided by the
+// node count
+type ClusterWideRateLimiterFactory interface {
+	RateLimiterFactory
+	ClusterWide() bool
+}
 
-func (f InMemoryGCRARateLimiterFactory) Build(reqsMinute int, burstSize int) (throttled.RateLimiter, error) {
-	// Use in-memory storage
-	maxKeys := 0 // no LRU (no keys limit)
-	store, err := memstore.New(maxKeys)
-	if err != nil {
-		return nil, err
+func isClusterWide(factory RateLimiterFactory) bool {
+	f, ok := factory.(ClusterWideRateLimiterFactory)
+	return ok && f.ClusterWide()
+}
+
+// NodeSplitRateLimiterFactory is implemented by the factories choosing how the cluster wide
+// settings are divided between the nodes (see WithNodeSplit)
+type NodeSplitRateLimiterFactory interface {
+	RateLimiterFactory
+	NodeSplit() NodeSplit
+}
+
+func nodeSplit(factory RateLimiterFactory) NodeSplit {
+	if f, ok := factory.(NodeSplitRateLimiterFactory); ok && f.NodeSplit() != nil {
+		return f.NodeSplit()
+	}
+	return valuePerNode
+}
+
+// WithNodeSplit wraps the factory, so the cluster aware rate limiters built with it divide
+// their settings with split instead of rounding up the value per node
+func WithNodeSplit(factory RateLimiterFactory, split NodeSplit) RateLimiterFactory {
+	return nodeSplitRateLimiterFactory{RateLimiterFactory: factory, split: split}
+}
+
+type nodeSplitRateLimiterFactory struct {
+	RateLimiterFactory
+	split NodeSplit
+}
+
+func (f nodeSplitRateLimiterFactory) NodeSplit() NodeSplit { return f.split }
+
+func (f nodeSplitRateLimiterFactory) ClusterWide() bool { return isClusterWide(f.RateLimiterFactory) }
+
+func (f nodeSplitRateLimiterFactory) Rebuild(previous throttled.RateLimiter, maxRequests int, period time.Duration,
+	burstSize int) (throttled.RateLimiter, error) {
+	if s, ok := f.RateLimiterFactory.(StatefulRateLimiterFactory); ok {
+		return s.Rebuild(previous, maxRequests, period, burstSize)
+	}
+	return f.Build(maxRequests, period, burstSize)
+}
+
+// Build the RateLimiterFactory for the configured store
+func NewRateLimiterFactory(cfg StoreConfig) (RateLimiterFactory, error) {
+	switch cfg.Type {
+	case "", MemoryStore:
+		return InMemoryGCRARateLimiterFactory{}, nil
+	case RedisStore:
+		return NewRedisGCRARateLimiterFactory(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown store type '%s'", cfg.Type)
 	}
+}
+
+type InMemoryGCRARateLimiterFactory struct{}
 
-	quota := throttled.RateQuota{throttled.PerMin(reqsMinute), burstSize}
-	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
+func (f InMemoryGCRARateLimiterFactory) Build(maxRequests int, period time.Duration, burstSize int) (throttled.RateLimiter, error) {
+	// Use in-memory storage (no keys limit)
+	rateLimiter, err := newMemGCRARateLimiter(newMemStore(), maxRequests, period, burstSize)
 	if err != nil {
 		return nil, err
 	}
 	return rateLimiter, nil
 }
+
+// throttled only allows building rates per second, minute, hour or day, so any
+// other period is converted to the equivalent (rounded) amount of requests per day
+func newRate(maxRequests int, period time.Duration) (throttled.Rate, error) {
+	if maxRequests <= 0 {
+		return throttled.Rate{}, fmt.Errorf("invalid rate: %d requests per %s", maxRequests, period)
+	}
+	switch period {
+	case time.Second:
+		return throttled.PerSec(maxRequests), nil
+	case time.Minute:
+		return throttled.PerMin(maxRequests), nil
+	case time.Hour:
+		return throttled.PerHour(maxRequests), nil
+	case 24 * time.Hour:
+		return throttled.PerDay(maxRequests), nil
+	}
+	if period <= 0 {
+		return throttled.Rate{}, fmt.Errorf("invalid rate: %d requests per %s", maxRequests, period)
+	}
+	perDay := float64(maxRequests) * float64(24*time.Hour) / float64(period)
+	if perDay < 1 || perDay > float64(24*time.Hour) {
+		return throttled.Rate{}, fmt.Errorf("unsupported rate: %d requests per %s", maxRequests, period)
+	}
+	return throttled.PerDay(int(math.Round(perDay))), nil
+}
@@ -7,6 +7,8 @@ package ratelimit
 
 import (
 	"math"
+	"sync"
+	"sync/atomic"
 
 	"github.com/throttled/throttled"
 )
@@ -18,74 +20,136 @@ type UpdatableRateLimiter interface {
 
 // Implements UpdatableRateLimiter, so, we can modify
 //  rate-limit settings in execution time
+// Every update builds a new rate limiter that is swapped atomically, so
+// RateLimit is safe to call while updating
 type DynamicRateLimiter struct {
+	mu         sync.Mutex   // serializes updates
+	generation atomic.Value // *rateLimiterGeneration
+	factory    RateLimiterFactory
+}
+
+// atomic.Value requires the same concrete type for every stored value
+type rateLimiterGeneration struct {
 	throttled.RateLimiter
-	factory RateLimiterFactory
 }
 
 func NewDynamicRateLimiter(factory RateLimiterFactory, settings RateLimiterSettings) (UpdatableRateLimiter, error) {
-	rateLimiter, err := factory.Build(settings.reqsMinute, settings.burstSize)
+	rateLimiter, err := factory.Build(settings.maxRequests, settings.period, settings.burstSize)
 	if err != nil {
 		return nil, err
 	}
-	return &DynamicRateLimiter{RateLimiter: rateLimiter, factory: factory}, nil
+	r := &DynamicRateLimiter{factory: factory}
+	r.generation.Store(&rateLimiterGeneration{rateLimiter})
+	return r, nil
 }
 
+// Update the rate limiter settings. If the factory is a StatefulRateLimiterFactory,
+// the state of the current rate limiter is kept
 func (r *DynamicRateLimiter) Update(settings RateLimiterSettings) error {
-	rateLimiter, err := r.factory.Build(settings.reqsMinute, settings.burstSize)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rateLimiter throttled.RateLimiter
+	var err error
+	if f, ok := r.factory.(StatefulRateLimiterFactory); ok {
+		rateLimiter, err = f.Rebuild(r.current(), settings.maxRequests, settings.period, settings.burstSize)
+	} else {
+		rateLimiter, err = r.factory.Build(settings.maxRequests, settings.period, settings.burstSize)
+	}
 	if err != nil {
 		return err
 	}
-	r.RateLimiter = rateLimiter
+	r.generation.Store(&rateLimiterGeneration{rateLimiter})
 	return nil
 }
 
+func (r *DynamicRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	return r.current().RateLimit(key, quantity)
+}
+
+func (r *DynamicRateLimiter) current() throttled.RateLimiter {
+	return r.generation.Load().(*rateLimiterGeneration).RateLimiter
+}
+
 type UpdatableClusterRateLimiter interface {
 	throttled.RateLimiter
 	UpdateNodeCount(nodes int) error
 	Nodes() int
 }
 
+// PolicyLimiter is implemented by the rate limiters knowing the settings applied to a key, so
+// the responses report the configured quota instead of the GCRA limit (burst + 1)
+type PolicyLimiter interface {
+	Policy(key string) (RateLimiterSettings, bool)
+}
+
+// rateLimitPolicy returns the settings applied to the key by rl, if it is a PolicyLimiter
+func rateLimitPolicy(rl throttled.RateLimiter, key string) (RateLimiterSettings, bool) {
+	if p, ok := rl.(PolicyLimiter); ok {
+		return p.Policy(key)
+	}
+	return RateLimiterSettings{}, false
+}
+
 // Updatable RateLimiter. Cluster aware (track node count).
-// Update node sttings depending on total node count
+// Update node sttings depending on total node count. If the factory
+// builds cluster wide rate limiters (shared state), settings are not divided.
+// nodes and settings are guarded by mu, which also serializes the updates
 type ClusterAwareRateLimiter struct {
+	mu          sync.RWMutex
 	nodes       int
+	clusterWide bool
+	split       NodeSplit
 	settings    RateLimiterSettings
+	applied     RateLimiterSettings // settings of the running node
 	rateLimiter UpdatableRateLimiter
 }
 
 func NewClusterAwareRateLimiter(factory RateLimiterFactory, nodes int, settings RateLimiterSettings) (UpdatableClusterRateLimiter, error) {
-	nodeSettings := nodeSettings(settings, nodes)
-	rateLimiter, err := NewDynamicRateLimiter(factory, nodeSettings)
+	r := &ClusterAwareRateLimiter{
+		nodes:       nodes,
+		clusterWide: isClusterWide(factory),
+		split:       nodeSplit(factory),
+		settings:    settings,
+	}
+	r.applied = r.nodeSettings(settings, nodes)
+	rateLimiter, err := NewDynamicRateLimiter(factory, r.applied)
 	if err != nil {
 		return nil, err
 	}
-	return &ClusterAwareRateLimiter{
-		nodes:       nodes,
-		settings:    settings,
-		rateLimiter: rateLimiter,
-	}, nil
+	r.rateLimiter = rateLimiter
+	return r, nil
 }
 
 func (r *ClusterAwareRateLimiter) Update(settings RateLimiterSettings) error {
-	nodeSettings := nodeSettings(settings, r.nodes)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nodeSettings := r.nodeSettings(settings, r.nodes)
 	err := r.rateLimiter.Update(nodeSettings)
 	if err != nil {
 		return err
 	}
 	r.settings = settings
+	r.applied = nodeSettings
 	return nil
 }
 
+// UpdateNodeCount rebuilds the rate limiter only if the settings of the node change. With an
+// index based NodeSplit, they can change without changes in the node count
 func (r *ClusterAwareRateLimiter) UpdateNodeCount(nodes int) error {
-	if r.nodes != nodes {
-		nodeSettings := nodeSettings(r.settings, nodes)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nodeSettings := r.nodeSettings(r.settings, nodes)
+	if nodeSettings != r.applied {
 		err := r.rateLimiter.Update(nodeSettings)
 		if err != nil {
 			return err
 		}
-		r.nodes = nodes
+		r.applied = nodeSettings
 	}
+	r.nodes = nodes
 	return nil
 }
 
@@ -93,15 +157,65 @@ func (r *ClusterAwareRateLimiter) RateLimit(key string, quantity int) (bool, thr
 	return r.rateLimiter.RateLimit(key, quantity)
 }
 
-func (r *ClusterAwareRateLimiter) Nodes() int { return r.nodes }
+// Policy returns the settings of the running node
+func (r *ClusterAwareRateLimiter) Policy(string) (RateLimiterSettings, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.applied, true
+}
+
+func (r *ClusterAwareRateLimiter) Nodes() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes
+}
+
+func (r *ClusterAwareRateLimiter) nodeSettings(settings RateLimiterSettings, nodes int) RateLimiterSettings {
+	return splitSettings(settings, nodes, r.clusterWide, r.split)
+}
 
-func nodeSettings(settings RateLimiterSettings, nodes int) RateLimiterSettings {
-	return RateLimiterSettings{
-		reqsMinute: valuePerNode(settings.reqsMinute, nodes),
-		burstSize:  valuePerNode(settings.burstSize, nodes),
+// splitSettings returns the share of the cluster wide settings for the running node
+func splitSettings(settings RateLimiterSettings, nodes int, clusterWide bool, split NodeSplit) RateLimiterSettings {
+	if clusterWide {
+		return settings
+	}
+	s := RateLimiterSettings{
+		maxRequests: split(settings.maxRequests, nodes),
+		period:      settings.period,
+		burstSize:   split(settings.burstSize, nodes),
 	}
+	// a rate limiter can not deny every request, so nodes with no share allow the minimum
+	if s.maxRequests < 1 {
+		s.maxRequests = 1
+	}
+	return s
 }
 
+// NodeSplit returns the share of a cluster wide value for the running node
+type NodeSplit func(clusterValue int, nodes int) int
+
 func valuePerNode(clusterValue int, n int) int {
+	if n < 1 {
+		n = 1
+	}
 	return int(math.Ceil(float64(clusterValue) / float64(n)))
 }
+
+// ExactNodeSplit gives every node the cluster value divided by the node count (rounded down),
+// plus one more for the nodes whose index is lower than the remainder, so the values of all
+// the nodes add up to the cluster value. Nodes with an unknown index get no remainder, so the
+// cluster allows less than the cluster value. A rate limiter can not deny every request, so
+// with fewer max requests than nodes, the nodes with no share still allow one request per
+// period and the cluster allows one per node instead
+func ExactNodeSplit(index NodeIndex) NodeSplit {
+	return func(clusterValue int, nodes int) int {
+		if nodes < 1 {
+			nodes = 1
+		}
+		v := clusterValue / nodes
+		if i := index(nodes); i >= 0 && i < clusterValue%nodes {
+			v++
+		}
+		return v
+	}
+}
@@ -0,0 +1,85 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/throttled/throttled"
+)
+
+// Time the primary rate limiter is skipped after a failure, so an unavailable store
+// does not add its timeout to every request
+const fallbackRetryInterval = time.Second
+
+// FallbackRateLimiter uses the fallback rate limiter while the primary one fails (e.g.
+// a local in-memory limiter while the shared store is down). The primary rate limiter
+// is retried once per fallbackRetryInterval
+type FallbackRateLimiter struct {
+	primary  UpdatableClusterRateLimiter
+	fallback UpdatableClusterRateLimiter
+	// retryAt is the unix time (in nanoseconds) until the primary rate limiter is skipped
+	retryAt int64
+	now     func() time.Time
+}
+
+func NewFallbackRateLimiter(primary, fallback UpdatableClusterRateLimiter) *FallbackRateLimiter {
+	return &FallbackRateLimiter{primary: primary, fallback: fallback, now: time.Now}
+}
+
+func (r *FallbackRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	return r.rateLimit(func(rl UpdatableClusterRateLimiter) (bool, throttled.RateLimitResult, error) {
+		return rl.RateLimit(key, quantity)
+	})
+}
+
+// RateLimitTenant works like RateLimit, with the settings of the tenant (see TenantRateLimiter)
+func (r *FallbackRateLimiter) RateLimitTenant(tenant, key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	return r.rateLimit(func(rl UpdatableClusterRateLimiter) (bool, throttled.RateLimitResult, error) {
+		return rateLimitTenant(rl, tenant, key, quantity)
+	})
+}
+
+func (r *FallbackRateLimiter) rateLimit(limit func(UpdatableClusterRateLimiter) (bool, throttled.RateLimitResult, error)) (bool, throttled.RateLimitResult, error) {
+	now := r.now().UnixNano()
+	if now < atomic.LoadInt64(&r.retryAt) {
+		return limit(r.fallback)
+	}
+	limited, result, err := limit(r.primary)
+	if err != nil {
+		atomic.StoreInt64(&r.retryAt, now+int64(fallbackRetryInterval))
+		return limit(r.fallback)
+	}
+	return limited, result, nil
+}
+
+// UpdateNodeCount updates both rate limiters, so the fallback one is ready with the
+// right settings when the primary one fails
+func (r *FallbackRateLimiter) UpdateNodeCount(nodes int) error {
+	err := r.primary.UpdateNodeCount(nodes)
+	if fErr := r.fallback.UpdateNodeCount(nodes); err == nil {
+		err = fErr
+	}
+	return err
+}
+
+func (r *FallbackRateLimiter) Nodes() int {
+	return r.primary.Nodes()
+}
+
+// Policy returns the settings of the rate limiter in use
+func (r *FallbackRateLimiter) Policy(key string) (RateLimiterSettings, bool) {
+	if r.Failing() {
+		return rateLimitPolicy(r.fallback, key)
+	}
+	return rateLimitPolicy(r.primary, key)
+}
+
+// Failing reports whether the fallback rate limiter is in use
+func (r *FallbackRateLimiter) Failing() bool {
+	return r.now().UnixNano() < atomic.LoadInt64(&r.retryAt)
+}
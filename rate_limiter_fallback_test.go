@@ -0,0 +1,90 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestFallbackRateLimiter(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start miniredis: %s", err.Error())
+	}
+	defer mr.Close()
+
+	// 2 nodes: 3 requests (burst + 1) cluster wide, 2 requests per node in the local fallback
+	cfg := RateLimitConfig{
+		Default:       RateLimitSettings{MaxRequests: 1, Period: time.Hour, BurstSize: 2},
+		Store:         StoreConfig{Type: RedisStore, Address: mr.Addr()},
+		FailurePolicy: FailLocal,
+	}
+	rl, ok := BuildRateLimiter(cfg, func() int { return 2 }, logger).(*FallbackRateLimiter)
+	if !ok {
+		t.Fatalf("Unexpected rate limiter type %T", rl)
+	}
+	clock := time.Now()
+	rl.now = func() time.Time { return clock }
+
+	checks := []struct {
+		name     string
+		down     bool
+		restart  bool
+		elapsed  time.Duration
+		expected []bool
+	}{
+		{name: "primary", expected: []bool{false}},
+		{name: "fallback", down: true, expected: []bool{false, false, true}},
+		{name: "fallback before the retry", elapsed: fallbackRetryInterval / 2, expected: []bool{true}},
+		// the request done before the failure is still in the store
+		{name: "primary recovered", restart: true, elapsed: fallbackRetryInterval, expected: []bool{false, false, true}},
+	}
+	for _, c := range checks {
+		if c.down {
+			mr.Close()
+		}
+		if c.restart {
+			if err := mr.Restart(); err != nil {
+				t.Fatalf("Unable to restart miniredis: %s", err.Error())
+			}
+		}
+		clock = clock.Add(c.elapsed)
+		for i, expected := range c.expected {
+			limited, _, err := rl.RateLimit("key", 1)
+			if err != nil {
+				t.Errorf("%s: request %d failed %s", c.name, i, err.Error())
+			}
+			if limited != expected {
+				t.Errorf("%s: unexpected limited value for request %d (expected: %t, got %t)", c.name, i, expected, limited)
+			}
+		}
+	}
+	if rl.Failing() {
+		t.Errorf("The primary rate limiter should be in use")
+	}
+
+	if err := rl.UpdateNodeCount(4); err != nil {
+		t.Errorf("UpdateNodeCount failed: %s", err.Error())
+	}
+	if n := rl.fallback.Nodes(); n != 4 {
+		t.Errorf("Unexpected fallback node count (expected: 4, got: %d)", n)
+	}
+}
+
+func TestBuildRateLimiterWithoutFallback(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	cfg := RateLimitConfig{Default: RateLimitSettings{MaxRequests: 10}, FailurePolicy: FailLocal}
+	if rl := BuildRateLimiter(cfg, DefaultNodeCounter(), logger); rl == nil {
+		t.Fatalf("Unable to build the rate limiter")
+	} else if _, ok := rl.(*FallbackRateLimiter); ok {
+		t.Errorf("The in-memory rate limiter should not have a fallback")
+	}
+}
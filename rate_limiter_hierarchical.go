@@ -0,0 +1,137 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/throttled/throttled"
+)
+
+// HierarchicalLimiter limits the requests by their key (e.g. the tenant) and by a sub key
+// within it (e.g. a user of the tenant)
+type HierarchicalLimiter interface {
+	RateLimitHierarchy(key, subKey string, quantity int) (bool, throttled.RateLimitResult, error)
+}
+
+// TenantRateLimiter is implemented by the rate limiters able to limit a key with the
+// settings of another one (the tenant), like MultiRateLimiter
+type TenantRateLimiter interface {
+	RateLimitTenant(tenant, key string, quantity int) (bool, throttled.RateLimitResult, error)
+}
+
+// rateLimitTenant uses the settings of the tenant if the rate limiter supports it
+func rateLimitTenant(rl throttled.RateLimiter, tenant, key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	if t, ok := rl.(TenantRateLimiter); ok {
+		return t.RateLimitTenant(tenant, key, quantity)
+	}
+	return rl.RateLimit(key, quantity)
+}
+
+// HierarchicalRateLimiter enforces the limit of the key (parent) and the limit of every sub
+// key within it (child), so a single user can not exhaust the budget of its tenant. A request
+// is only counted when both levels allow it. Implements UpdatableClusterRateLimiter
+type HierarchicalRateLimiter struct {
+	parent UpdatableClusterRateLimiter
+	child  UpdatableClusterRateLimiter
+}
+
+// NewHierarchicalRateLimiter builds the rate limiter of both levels. The buckets of the child
+// are the hierarchyKey of the key and the sub key, limited with the settings of the key if the
+// child is a TenantRateLimiter
+func NewHierarchicalRateLimiter(parent, child UpdatableClusterRateLimiter) *HierarchicalRateLimiter {
+	return &HierarchicalRateLimiter{parent: parent, child: child}
+}
+
+// RateLimit only applies the limit of the key, for the requests without sub key
+func (r *HierarchicalRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	return r.parent.RateLimit(key, quantity)
+}
+
+// RateLimitHierarchy only consumes quantity when both levels allow it (see rateLimitLevels),
+// so a denied sub key does not consume the budget of its key, and a denied key does not consume
+// the budget of its sub key. The returned result is the one of the denying level or, if the
+// request is allowed, the one with the fewer remaining requests
+func (r *HierarchicalRateLimiter) RateLimitHierarchy(key, subKey string, quantity int) (bool, throttled.RateLimitResult, error) {
+	childKey := hierarchyKey(key, subKey)
+	return rateLimitLevels([]rateLimitLevel{
+		func(quantity int) (bool, throttled.RateLimitResult, error) {
+			return rateLimitTenant(r.child, key, childKey, quantity)
+		},
+		func(quantity int) (bool, throttled.RateLimitResult, error) {
+			return r.parent.RateLimit(key, quantity)
+		},
+	}, quantity)
+}
+
+// hierarchyKey returns the bucket of the sub key within the key. The keys (IPv6 addresses,
+// composite keys) may contain the separator, so the key is prefixed with its length and
+// different pairs never share a bucket (e.g. a:b and c, a and b:c)
+func hierarchyKey(key, subKey string) string {
+	return strconv.Itoa(len(key)) + compositeKeySeparator + key + compositeKeySeparator + subKey
+}
+
+func (r *HierarchicalRateLimiter) UpdateNodeCount(nodes int) error {
+	err := r.parent.UpdateNodeCount(nodes)
+	if cErr := r.child.UpdateNodeCount(nodes); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Policy returns the settings of the key, not the ones of its sub keys
+func (r *HierarchicalRateLimiter) Policy(key string) (RateLimiterSettings, bool) {
+	return rateLimitPolicy(r.parent, key)
+}
+
+func (r *HierarchicalRateLimiter) Nodes() int {
+	return r.parent.Nodes()
+}
+
+// subLimitConfig returns the config of the child level: the settings of the config scaled
+// by the fraction, or the absolute limit for every key
+func subLimitConfig(c RateLimitConfig) RateLimitConfig {
+	sub := c
+	sub.SubLimit = SubLimitConfig{}
+	// the buckets of both levels must not collide in a shared store
+	sub.Store.KeyPrefix = c.Store.KeyPrefix + "sub:"
+	if c.SubLimit.Fraction <= 0 {
+		sub.Default = c.SubLimit.Limit
+		sub.Custom, sub.Plans, sub.Tenants, sub.TenantsFile = nil, nil, nil, ""
+		return sub
+	}
+
+	f := c.SubLimit.Fraction
+	sub.Default = scaleSettings(c.Default, f)
+	sub.Custom = make(map[string]RateLimitSettings, len(c.Custom))
+	for k, s := range c.Custom {
+		sub.Custom[k] = scaleSettings(s, f)
+	}
+	sub.Plans = make(map[string]RateLimitSettings, len(c.Plans))
+	for k, s := range c.Plans {
+		sub.Plans[k] = scaleSettings(s, f)
+	}
+	return sub
+}
+
+// scaleSettings multiplies the max requests (at least 1) and the burst of every window
+func scaleSettings(s RateLimitSettings, fraction float64) RateLimitSettings {
+	scaled := s
+	if len(s.Windows) > 0 {
+		scaled.Windows = make([]RateLimitSettings, len(s.Windows))
+		for i, w := range s.Windows {
+			scaled.Windows[i] = scaleSettings(w, fraction)
+		}
+		return scaled
+	}
+	scaled.MaxRequests = int(math.Ceil(float64(s.MaxRequests) * fraction))
+	if scaled.MaxRequests < 1 {
+		scaled.MaxRequests = 1
+	}
+	scaled.BurstSize = int(float64(s.BurstSize) * fraction)
+	return scaled
+}
@@ -0,0 +1,205 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
+)
+
+func assertHierarchy(t *testing.T, rl HierarchicalLimiter, key, subKey string, expected ...bool) {
+	for i, e := range expected {
+		limited, _, err := rl.RateLimitHierarchy(key, subKey, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if limited != e {
+			t.Errorf("Unexpected limited value for %s/%s request %d (expected: %t, got: %t)", key, subKey, i, e, limited)
+		}
+	}
+}
+
+func TestHierarchicalRateLimiter(t *testing.T) {
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	tenant, _ := NewClusterAwareRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 3, period: time.Hour, burstSize: 2})
+	user, _ := NewClusterAwareRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 2, period: time.Hour, burstSize: 1})
+	rl := NewHierarchicalRateLimiter(tenant, user)
+
+	// the denied request of user-1 does not consume the tenant budget
+	assertHierarchy(t, rl, "kufar.com", "user-1", false, false)
+	limited, result, _ := rl.RateLimitHierarchy("kufar.com", "user-1", 1)
+	if !limited || result.Limit != 2 || result.RetryAfter <= 0 {
+		t.Errorf("Unexpected user limit result: %t %+v", limited, result)
+	}
+	limited, result, _ = rl.RateLimitHierarchy("kufar.com", "user-2", 1)
+	if limited || result.Remaining != 0 || result.Limit != 3 {
+		t.Errorf("Unexpected most restrictive result: %t %+v", limited, result)
+	}
+	// the request denied by the tenant does not consume the user-2 budget
+	limited, result, _ = rl.RateLimitHierarchy("kufar.com", "user-2", 1)
+	if !limited || result.Limit != 3 {
+		t.Errorf("Unexpected tenant limit result: %t %+v", limited, result)
+	}
+	if _, result, _ = user.RateLimit(hierarchyKey("kufar.com", "user-2"), 0); result.Remaining != 1 {
+		t.Errorf("Unexpected user-2 remaining requests (expected: 1, got: %d)", result.Remaining)
+	}
+	// other tenants are not affected
+	assertHierarchy(t, rl, "corotos.com", "user-1", false, false, true)
+	// the sub keys of keys containing the separator do not share their bucket
+	assertHierarchy(t, rl, "2001:db8::1", "user-1", false, false, true)
+	assertHierarchy(t, rl, "2001:db8:", ":1:user-1", false, false, true)
+
+	if err := rl.UpdateNodeCount(2); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if tenant.Nodes() != 2 || user.Nodes() != 2 {
+		t.Errorf("The node count must be updated at both levels")
+	}
+}
+
+func TestHierarchyKey(t *testing.T) {
+	checks := []struct {
+		key      string
+		subKey   string
+		expected string
+	}{
+		{key: "kufar.com", subKey: "user-1", expected: "9:kufar.com:user-1"},
+		{key: "a:b", subKey: "c", expected: "3:a:b:c"},
+		{key: "a", subKey: "b:c", expected: "1:a:b:c"},
+		{key: "", subKey: "1:a", expected: "0::1:a"},
+	}
+	for _, c := range checks {
+		if got := hierarchyKey(c.key, c.subKey); got != c.expected {
+			t.Errorf("Unexpected hierarchy key of %s/%s (expected: %s, got: %s)", c.key, c.subKey, c.expected, got)
+		}
+	}
+}
+
+func TestBuildHierarchicalRateLimiter(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	file := filepath.Join(t.TempDir(), "tenants.csv")
+	ioutil.WriteFile(file, []byte("partner.com,free\n"), 0600)
+	cfg := RateLimitConfig{
+		Default:     RateLimitSettings{MaxRequests: 100, BurstSize: 99, Period: time.Hour},
+		Custom:      map[string]RateLimitSettings{"kufar.com": {MaxRequests: 10, BurstSize: 9, Period: time.Hour}},
+		Plans:       map[string]RateLimitSettings{"free": {MaxRequests: 4, BurstSize: 3, Period: time.Hour}},
+		TenantsFile: file,
+		SubLimit:    SubLimitConfig{Fraction: 0.5},
+	}
+	rl := BuildRateLimiter(cfg, func() int { return 1 }, logger).(*HierarchicalRateLimiter)
+
+	// every user gets half of the tenant budget
+	assertHierarchy(t, rl, "kufar.com", "a", false, false, false, false, false, true)
+	assertHierarchy(t, rl, "kufar.com", "b", false, false, false, false, false, true)
+	assertHierarchy(t, rl, "kufar.com", "c", true)
+	assertHierarchy(t, rl, "partner.com", "a", false, false, true)
+
+	// the sub limits follow the plan changes
+	ioutil.WriteFile(file, []byte("partner.com,pro\n"), 0600)
+	cfg.Plans["pro"] = RateLimitSettings{MaxRequests: 8, BurstSize: 7, Period: time.Hour}
+	if err := ReloadPlans(rl, cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	assertHierarchy(t, rl, "partner.com", "b", false, false, false, false, true)
+
+	cfg.SubLimit = SubLimitConfig{Limit: RateLimitSettings{MaxRequests: 1, Period: time.Hour}}
+	rl = BuildRateLimiter(cfg, func() int { return 1 }, logger).(*HierarchicalRateLimiter)
+	assertHierarchy(t, rl, "kufar.com", "a", false, true)
+	assertHierarchy(t, rl, "other.com", "a", false, true)
+	if err := ReloadPlans(rl, cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+}
+
+func TestScaleSettings(t *testing.T) {
+	checks := []struct {
+		settings RateLimitSettings
+		fraction float64
+		expected RateLimitSettings
+	}{
+		{
+			settings: RateLimitSettings{MaxRequests: 600, BurstSize: 5},
+			fraction: 0.1,
+			expected: RateLimitSettings{MaxRequests: 60},
+		},
+		{
+			settings: RateLimitSettings{MaxRequests: 5, BurstSize: 10, Period: time.Second},
+			fraction: 0.1,
+			expected: RateLimitSettings{MaxRequests: 1, BurstSize: 1, Period: time.Second},
+		},
+		{
+			settings: RateLimitSettings{Windows: []RateLimitSettings{{MaxRequests: 20, Period: time.Second}, {MaxRequests: 1000, Period: 24 * time.Hour}}},
+			fraction: 0.25,
+			expected: RateLimitSettings{Windows: []RateLimitSettings{{MaxRequests: 5, Period: time.Second}, {MaxRequests: 250, Period: 24 * time.Hour}}},
+		},
+	}
+	for _, c := range checks {
+		if got := scaleSettings(c.settings, c.fraction); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Unexpected settings (expected: %+v, got: %+v)", c.expected, got)
+		}
+	}
+}
+
+func TestGinRateLimiterSubLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	cfg := RateLimitConfig{
+		Default:  RateLimitSettings{MaxRequests: 3, BurstSize: 2, Period: time.Hour},
+		Key:      KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-Tenant"}}},
+		SubLimit: SubLimitConfig{Limit: RateLimitSettings{MaxRequests: 2, BurstSize: 1, Period: time.Hour}},
+	}
+	rl, err := NewGinRateLimiter(BuildRateLimiter(cfg, func() int { return 1 }, logger), nil, cfg, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	engine := gin.New()
+	engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	for i, c := range []struct {
+		remote   string
+		expected int
+	}{
+		{remote: "203.0.113.7:5000", expected: http.StatusOK},
+		{remote: "203.0.113.7:5000", expected: http.StatusOK},
+		// the client IP is limited, not the tenant
+		{remote: "203.0.113.7:5000", expected: http.StatusTooManyRequests},
+		{remote: "198.51.100.1:5000", expected: http.StatusOK},
+		// the tenant is limited
+		{remote: "192.0.2.1:5000", expected: http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Tenant", "kufar.com")
+		engine.ServeHTTP(w, req)
+		if w.Code != c.expected {
+			t.Errorf("Unexpected status of request %d (expected: %d, got: %d)", i, c.expected, w.Code)
+		}
+	}
+
+	cfg.SubLimit.Key = KeyConfig{Sources: []KeySource{{Type: HeaderKeySource, Name: "X-User"}}, Missing: MissingKeyReject}
+	rl, err = NewGinRateLimiter(BuildRateLimiter(cfg, func() int { return 1 }, logger), nil, cfg, logger)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	engine = gin.New()
+	engine.GET("/", rl.RateLimit(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "kufar.com")
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status without sub key (expected: %d, got: %d)", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -5,62 +5,191 @@
 
 package ratelimit
 
-import "github.com/throttled/throttled"
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/throttled/throttled"
+)
 
 // Allows different GinRateLimit settings per siteKey (issuer)
 //  implements UpdatableClusterRateLimiter (so it's cluster
 //  aware and it can be updated in execution time)
+//
+// The custom keys can also be suffixes (*.kufar.com), globs (kufar-*) or regexes
+// (~^tenant-[0-9]+$). The exact key wins, then the longest suffix, then the first
+// glob or regex in alphabetical order and then the default. Every matching siteKey
+// still has its own bucket
+//
+// The siteKeys mapped to a plan share the rate limiter of the plan (but not its buckets).
+// They come after the exact custom keys
 type MultiRateLimiter struct {
+	mu        sync.RWMutex // guards nodes and serializes the updates
 	nodes     int
+	factory   RateLimiterFactory
 	customRL  map[string]UpdatableClusterRateLimiter
+	plans     atomic.Value // *planTable
+	suffixes  []tenantSuffix
+	patterns  []tenantPattern
+	matches   tenantMatchCache
 	defaultRL UpdatableClusterRateLimiter
 }
 
 func NewMultiRateLimiter(factory RateLimiterFactory, nodes int, defaultSettings RateLimiterSettings,
 	customSettings map[string]RateLimiterSettings) (UpdatableClusterRateLimiter, error) {
 
-	var err error
-	customRL := make(map[string]UpdatableClusterRateLimiter)
+	customWindows := make(map[string][]RateLimiterSettings, len(customSettings))
 	for k, v := range customSettings {
-		customRL[k], err = NewClusterAwareRateLimiter(factory, nodes, v)
+		customWindows[k] = []RateLimiterSettings{v}
+	}
+	return NewMultiRateLimiterWithWindows(factory, nodes, []RateLimiterSettings{defaultSettings}, customWindows)
+}
+
+// Same as NewMultiRateLimiter, but every siteKey can enforce several windows at once
+func NewMultiRateLimiterWithWindows(factory RateLimiterFactory, nodes int, defaultWindows []RateLimiterSettings,
+	customWindows map[string][]RateLimiterSettings) (UpdatableClusterRateLimiter, error) {
+	r, err := NewMultiRateLimiterWithPlans(factory, nodes, defaultWindows, customWindows, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Same as NewMultiRateLimiterWithWindows, with named plans and the plan of every tenant
+// (see UpdatePlans)
+func NewMultiRateLimiterWithPlans(factory RateLimiterFactory, nodes int, defaultWindows []RateLimiterSettings,
+	customWindows map[string][]RateLimiterSettings, plans map[string][]RateLimiterSettings,
+	tenants map[string]string) (*MultiRateLimiter, error) {
+
+	keys := make([]string, 0, len(customWindows))
+	for k := range customWindows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := &MultiRateLimiter{nodes: nodes, factory: factory, customRL: make(map[string]UpdatableClusterRateLimiter)}
+	for _, k := range keys {
+		rl, err := NewWindowsRateLimiter(factory, nodes, customWindows[k])
+		if err != nil {
+			return nil, err
+		}
+		if suffix, ok := tenantSuffixOf(k); ok {
+			r.suffixes = append(r.suffixes, tenantSuffix{suffix: suffix, rateLimiter: rl})
+			continue
+		}
+		if !isTenantPattern(k) {
+			r.customRL[k] = rl
+			continue
+		}
+		pattern, err := compileTenantPattern(k)
 		if err != nil {
 			return nil, err
 		}
+		r.patterns = append(r.patterns, tenantPattern{pattern: pattern, rateLimiter: rl})
 	}
-	defaultRL, err := NewClusterAwareRateLimiter(factory, nodes, defaultSettings)
+	// the longest suffix wins
+	sort.SliceStable(r.suffixes, func(i, j int) bool {
+		return len(r.suffixes[i].suffix) > len(r.suffixes[j].suffix)
+	})
+
+	if err := r.UpdatePlans(plans, tenants); err != nil {
+		return nil, err
+	}
+
+	var err error
+	r.defaultRL, err = NewWindowsRateLimiter(factory, nodes, defaultWindows)
 	if err != nil {
 		return nil, err
 	}
-	return &MultiRateLimiter{
-		nodes:     nodes,
-		customRL:  customRL,
-		defaultRL: defaultRL,
-	}, nil
+	return r, nil
 }
 
 func (r *MultiRateLimiter) UpdateNodeCount(nodes int) error {
-	if r.nodes != nodes {
-		err := r.defaultRL.UpdateNodeCount(nodes)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// always propagated: the rate limiters skip the updates not changing their settings
+	err := r.defaultRL.UpdateNodeCount(nodes)
+	if err != nil {
+		return err
+	}
+	for _, rl := range r.customRL {
+		err = rl.UpdateNodeCount(nodes)
 		if err != nil {
 			return err
 		}
-		for _, rl := range r.customRL {
-			rl.UpdateNodeCount(nodes)
-			if err != nil {
-				return err
-			}
+	}
+	for _, s := range r.suffixes {
+		if err = s.rateLimiter.UpdateNodeCount(nodes); err != nil {
+			return err
+		}
+	}
+	for _, p := range r.patterns {
+		if err = p.rateLimiter.UpdateNodeCount(nodes); err != nil {
+			return err
 		}
-		r.nodes = nodes
 	}
+	for _, rl := range r.planTable().plans {
+		if err = rl.UpdateNodeCount(nodes); err != nil {
+			return err
+		}
+	}
+	r.nodes = nodes
 	return nil
 }
 
 func (r *MultiRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
-	rateLimiter, ok := r.customRL[key]
-	if !ok {
-		rateLimiter = r.defaultRL
+	return r.rateLimiter(key).RateLimit(key, quantity)
+}
+
+// RateLimitTenant limits the key with the rate limiter of the tenant (e.g. the users of a tenant)
+func (r *MultiRateLimiter) RateLimitTenant(tenant, key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	return r.rateLimiter(tenant).RateLimit(key, quantity)
+}
+
+// rateLimiter returns the rate limiter of the key. The matches of the suffixes and the
+// patterns are cached
+func (r *MultiRateLimiter) rateLimiter(key string) UpdatableClusterRateLimiter {
+	if rl, ok := r.customRL[key]; ok {
+		return rl
+	}
+	if rl, ok := r.planTable().tenants[key]; ok {
+		return rl
+	}
+	if len(r.suffixes) == 0 && len(r.patterns) == 0 {
+		return r.defaultRL
+	}
+	if rl, ok := r.matches.get(key); ok {
+		return rl
 	}
-	return rateLimiter.RateLimit(key, quantity)
+	rl := r.match(key)
+	r.matches.add(key, rl)
+	return rl
 }
 
-func (r *MultiRateLimiter) Nodes() int { return r.nodes }
+func (r *MultiRateLimiter) match(key string) UpdatableClusterRateLimiter {
+	for _, s := range r.suffixes {
+		if strings.HasSuffix(key, s.suffix) {
+			return s.rateLimiter
+		}
+	}
+	for _, p := range r.patterns {
+		if p.pattern.MatchString(key) {
+			return p.rateLimiter
+		}
+	}
+	return r.defaultRL
+}
+
+// Policy returns the settings of the rate limiter of the key
+func (r *MultiRateLimiter) Policy(key string) (RateLimiterSettings, bool) {
+	return rateLimitPolicy(r.rateLimiter(key), key)
+}
+
+func (r *MultiRateLimiter) Nodes() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes
+}
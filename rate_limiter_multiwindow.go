@@ -0,0 +1,197 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/throttled/throttled"
+)
+
+// Builds a ClusterAwareRateLimiter for a single window or a
+// MultiWindowRateLimiter enforcing all of them
+func NewWindowsRateLimiter(factory RateLimiterFactory, nodes int, windows []RateLimiterSettings) (UpdatableClusterRateLimiter, error) {
+	switch len(windows) {
+	case 0:
+		return nil, errors.New("at least one rate limit window is required")
+	case 1:
+		return NewClusterAwareRateLimiter(factory, nodes, windows[0])
+	default:
+		return NewMultiWindowRateLimiter(factory, nodes, windows)
+	}
+}
+
+// Enforces several windows (e.g. per second AND per day) for the same key.
+// A request is only counted if every window allows it. Implements
+// UpdatableClusterRateLimiter
+type MultiWindowRateLimiter struct {
+	mu      sync.RWMutex // guards nodes and serializes the updates
+	nodes   int
+	windows []UpdatableClusterRateLimiter
+}
+
+func NewMultiWindowRateLimiter(factory RateLimiterFactory, nodes int, windows []RateLimiterSettings) (UpdatableClusterRateLimiter, error) {
+	rateLimiters := make([]UpdatableClusterRateLimiter, len(windows))
+	for i, w := range windows {
+		rl, err := NewClusterAwareRateLimiter(factory, nodes, w)
+		if err != nil {
+			return nil, err
+		}
+		rateLimiters[i] = rl
+	}
+	return &MultiWindowRateLimiter{
+		nodes:   nodes,
+		windows: rateLimiters,
+	}, nil
+}
+
+func (r *MultiWindowRateLimiter) UpdateNodeCount(nodes int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// always propagated: the windows skip the updates not changing their settings
+	for _, rl := range r.windows {
+		err := rl.UpdateNodeCount(nodes)
+		if err != nil {
+			return err
+		}
+	}
+	r.nodes = nodes
+	return nil
+}
+
+// RateLimit only consumes quantity when every window allows it (see rateLimitLevels). The
+// returned result is the one of the most restrictive window: the denying window with the
+// longest RetryAfter or, if the request is allowed, the window with the fewer remaining requests
+func (r *MultiWindowRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	levels := make([]rateLimitLevel, len(r.windows))
+	for i, rl := range r.windows {
+		rl := rl
+		levels[i] = func(quantity int) (bool, throttled.RateLimitResult, error) {
+			return rl.RateLimit(key, quantity)
+		}
+	}
+	return rateLimitLevels(levels, quantity)
+}
+
+// rateLimitLevel applies a quantity to one of the limits enforced together
+type rateLimitLevel func(quantity int) (bool, throttled.RateLimitResult, error)
+
+// rateLimitLevels peeks (quantity 0) at every level first and only consumes quantity once
+// all of them allow it. A level consuming the quantity while the request is denied (it was
+// refilled or a concurrent request took the last slot since it was peeked) gets it back, so
+// a denied request is never counted. Zero and negative quantities are applied to every level
+func rateLimitLevels(levels []rateLimitLevel, quantity int) (bool, throttled.RateLimitResult, error) {
+	if quantity <= 0 {
+		return applyLevels(levels, quantity)
+	}
+
+	results := make([]throttled.RateLimitResult, len(levels))
+	consumed := make([]bool, len(levels))
+	denied := -1
+	var deniedResult throttled.RateLimitResult
+	for i, level := range levels {
+		limited, result, err := level(0)
+		if err != nil {
+			refundLevels(levels, consumed, quantity)
+			return false, result, err
+		}
+		if !limited && result.Remaining >= quantity {
+			results[i] = result
+			continue
+		}
+		// peeking does not compute RetryAfter, so ask the level itself (it is
+		// not updated when it denies the request)
+		limited, result, err = level(quantity)
+		if err != nil {
+			refundLevels(levels, consumed, quantity)
+			return false, result, err
+		}
+		if !limited {
+			// the level was refilled meanwhile, so the quantity has been consumed
+			results[i], consumed[i] = result, true
+			continue
+		}
+		if denied == -1 || result.RetryAfter > deniedResult.RetryAfter {
+			denied = i
+			deniedResult = result
+		}
+	}
+	if denied != -1 {
+		refundLevels(levels, consumed, quantity)
+		return true, deniedResult, nil
+	}
+
+	for i, level := range levels {
+		if consumed[i] {
+			continue
+		}
+		limited, result, err := level(quantity)
+		if err != nil {
+			refundLevels(levels, consumed, quantity)
+			return false, result, err
+		}
+		if limited {
+			// a concurrent request took the last slot since we peeked
+			refundLevels(levels, consumed, quantity)
+			return true, result, nil
+		}
+		results[i], consumed[i] = result, true
+	}
+	return false, mostRestrictive(results), nil
+}
+
+// applyLevels applies the quantity to every level. The request is limited if any level limits it
+func applyLevels(levels []rateLimitLevel, quantity int) (bool, throttled.RateLimitResult, error) {
+	results := make([]throttled.RateLimitResult, len(levels))
+	limited := false
+	for i, level := range levels {
+		l, result, err := level(quantity)
+		if err != nil {
+			return false, result, err
+		}
+		limited = limited || l
+		results[i] = result
+	}
+	return limited, mostRestrictive(results), nil
+}
+
+// refundLevels gives the quantity back to the levels that consumed it. GCRA rate limiters
+// accept negative quantities, and their buckets can not be refilled over the limit. It is
+// done on a best effort basis: a level failing now keeps the quantity
+func refundLevels(levels []rateLimitLevel, consumed []bool, quantity int) {
+	for i, level := range levels {
+		if consumed[i] {
+			level(-quantity)
+		}
+	}
+}
+
+// mostRestrictive returns the result with the fewer remaining requests
+func mostRestrictive(results []throttled.RateLimitResult) throttled.RateLimitResult {
+	var restrictive throttled.RateLimitResult
+	for i, result := range results {
+		if i == 0 || result.Remaining < restrictive.Remaining {
+			restrictive = result
+		}
+	}
+	return restrictive
+}
+
+// Policy returns the settings of the first window
+func (r *MultiWindowRateLimiter) Policy(key string) (RateLimiterSettings, bool) {
+	if len(r.windows) == 0 {
+		return RateLimiterSettings{}, false
+	}
+	return rateLimitPolicy(r.windows[0], key)
+}
+
+func (r *MultiWindowRateLimiter) Nodes() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes
+}
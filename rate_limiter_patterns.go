@@ -0,0 +1,82 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// RegexTenantPrefix marks the custom keys that are regular expressions (e.g. ~^tenant-[0-9]+$)
+	RegexTenantPrefix = "~"
+	// SuffixTenantPrefix marks the custom keys matching every subdomain (e.g. *.kufar.com)
+	SuffixTenantPrefix = "*."
+)
+
+// Max number of keys whose match is cached. The cache is emptied when it is full, so
+// clients sending random keys can not make it grow without bounds
+const maxCachedTenantMatches = 10000
+
+// tenantSuffix is a custom rate limiter for the keys ending with suffix
+type tenantSuffix struct {
+	suffix      string
+	rateLimiter UpdatableClusterRateLimiter
+}
+
+// tenantPattern is a custom rate limiter for the keys matching a glob or a regex
+type tenantPattern struct {
+	pattern     *regexp.Regexp
+	rateLimiter UpdatableClusterRateLimiter
+}
+
+// isTenantPattern reports whether the custom key matches other keys than itself
+func isTenantPattern(key string) bool {
+	return strings.HasPrefix(key, RegexTenantPrefix) || strings.ContainsAny(key, "*?")
+}
+
+// tenantSuffixOf returns the suffix of the *.kufar.com keys (.kufar.com)
+func tenantSuffixOf(key string) (string, bool) {
+	if !strings.HasPrefix(key, SuffixTenantPrefix) || strings.ContainsAny(key[len(SuffixTenantPrefix):], "*?") {
+		return "", false
+	}
+	return key[len(SuffixTenantPrefix)-1:], true
+}
+
+// compileTenantPattern compiles a regex (~ prefix) or a glob, where * matches any
+// sequence of characters and ? a single one
+func compileTenantPattern(key string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(key, RegexTenantPrefix) {
+		return regexp.Compile(key[len(RegexTenantPrefix):])
+	}
+	expr := regexp.QuoteMeta(key)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.Compile("^" + expr + "$")
+}
+
+// tenantMatchCache remembers the rate limiter matched by every key
+type tenantMatchCache struct {
+	mu      sync.RWMutex
+	matches map[string]UpdatableClusterRateLimiter
+}
+
+func (c *tenantMatchCache) get(key string) (UpdatableClusterRateLimiter, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rl, ok := c.matches[key]
+	return rl, ok
+}
+
+func (c *tenantMatchCache) add(key string, rl UpdatableClusterRateLimiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.matches == nil || len(c.matches) >= maxCachedTenantMatches {
+		c.matches = make(map[string]UpdatableClusterRateLimiter)
+	}
+	c.matches[key] = rl
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMultiRateLimiterPatterns(t *testing.T) {
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	// every entry has its own max requests, so the matched one can be identified
+	custom := map[string]RateLimiterSettings{}
+	for i, k := range []string{
+		"kufar.com",
+		"*.kufar.com",
+		"*.api.kufar.com",
+		"*.com",
+		"kufar-*",
+		"kufar-?.by",
+		"~^tenant-[0-9]+$",
+		"~^tenant-",
+		"a.kufar.com?",
+	} {
+		custom[k] = RateLimiterSettings{maxRequests: 10 * (i + 1), period: time.Minute}
+	}
+	rl, err := NewMultiRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 1, period: time.Minute}, custom)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	multi := rl.(*MultiRateLimiter)
+
+	checks := []struct {
+		key      string
+		expected string
+	}{
+		{key: "kufar.com", expected: "kufar.com"},
+		{key: "a.kufar.com", expected: "*.kufar.com"},
+		{key: "b.a.kufar.com", expected: "*.kufar.com"},
+		{key: "b.api.kufar.com", expected: "*.api.kufar.com"},
+		{key: "api.kufar.com", expected: "*.kufar.com"},
+		{key: "corotos.com", expected: "*.com"},
+		{key: "kufar-by.com", expected: "*.com"},
+		{key: "kufar-by", expected: "kufar-*"},
+		{key: "kufar-1.by", expected: "kufar-*"},
+		{key: "tenant-42", expected: "~^tenant-"},
+		{key: "tenant-x", expected: "~^tenant-"},
+		{key: "a.kufar.comx", expected: "a.kufar.com?"},
+		{key: "a.kufar.co", expected: ""},
+		{key: "kufar", expected: ""},
+		{key: "ku.*", expected: ""},
+	}
+
+	for _, c := range checks {
+		expected := 1
+		if c.expected != "" {
+			expected = custom[c.expected].maxRequests
+		}
+		// the second lookup is served by the cache
+		for i := 0; i < 2; i++ {
+			got := multi.rateLimiter(c.key).(*ClusterAwareRateLimiter).settings.maxRequests
+			if got != expected {
+				t.Errorf("Unexpected rate limiter for %s (expected: %d, got: %d)", c.key, expected, got)
+			}
+		}
+	}
+}
+
+func TestMultiRateLimiterPatternBuckets(t *testing.T) {
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	custom := map[string]RateLimiterSettings{"*.kufar.com": {maxRequests: 1, period: time.Hour}}
+	rl, err := NewMultiRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 100, period: time.Minute}, custom)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// every subdomain has its own bucket with the pattern settings
+	for _, key := range []string{"a.kufar.com", "b.kufar.com"} {
+		for i, expected := range []bool{false, true} {
+			limited, _, err := rl.RateLimit(key, 1)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if limited != expected {
+				t.Errorf("Unexpected limited value for %s request %d (expected: %t, got: %t)", key, i, expected, limited)
+			}
+		}
+	}
+}
+
+func TestMultiRateLimiterInvalidPattern(t *testing.T) {
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	custom := map[string]RateLimiterSettings{"~tenant-(": {maxRequests: 1, period: time.Minute}}
+	if _, err := NewMultiRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 1, period: time.Minute}, custom); err == nil {
+		t.Errorf("An error is expected for an invalid regex")
+	}
+}
+
+func TestTenantMatchCacheBounds(t *testing.T) {
+	c := tenantMatchCache{}
+	for i := 0; i <= maxCachedTenantMatches; i++ {
+		c.add(strconv.Itoa(i), nil)
+	}
+	if len(c.matches) != 1 {
+		t.Errorf("Unexpected cache size (expected: 1, got: %d)", len(c.matches))
+	}
+}
@@ -0,0 +1,297 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// planTable is the rate limiter of every plan and the one of every tenant mapped to a plan.
+// It is never modified, the updates store a new one
+type planTable struct {
+	windows map[string][]RateLimiterSettings
+	plans   map[string]UpdatableClusterRateLimiter
+	tenants map[string]UpdatableClusterRateLimiter
+}
+
+// UpdatePlans replaces the plans and the tenant to plan mapping. The rate limiters of the
+// unchanged plans are kept, and the changed ones are updated in place when they keep the
+// number of windows, so the buckets of their tenants are not reset. The settings of every
+// new or changed plan are checked, and only the plans that can not be updated in place are
+// built, before updating any rate limiter, so a failed update changes nothing
+func (r *MultiRateLimiter) UpdatePlans(plans map[string][]RateLimiterSettings, tenants map[string]string) error {
+	for tenant, plan := range tenants {
+		if _, ok := plans[plan]; !ok {
+			return fmt.Errorf("unknown plan '%s' of tenant '%s'", plan, tenant)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.planTable()
+	changed, err := r.changedPlans(previous, plans)
+	if err != nil {
+		return err
+	}
+	built := map[string]UpdatableClusterRateLimiter{}
+	updated := map[string][]*ClusterAwareRateLimiter{}
+	for _, name := range changed {
+		if windows := clusterWindows(previous.plans[name], len(plans[name])); windows != nil {
+			updated[name] = windows
+			continue
+		}
+		rl, err := NewWindowsRateLimiter(r.factory, r.nodes, plans[name])
+		if err != nil {
+			return err
+		}
+		built[name] = rl
+	}
+	for name, windows := range updated {
+		for i, window := range windows {
+			// the settings are checked, so only a failing store fails the update
+			if err := window.Update(plans[name][i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	table := &planTable{
+		windows: plans,
+		plans:   make(map[string]UpdatableClusterRateLimiter, len(plans)),
+		tenants: make(map[string]UpdatableClusterRateLimiter, len(tenants)),
+	}
+	for name := range plans {
+		rl, ok := built[name]
+		if !ok {
+			rl = previous.plans[name]
+		}
+		table.plans[name] = rl
+	}
+	for tenant, plan := range tenants {
+		table.tenants[tenant] = table.plans[plan]
+	}
+	r.plans.Store(table)
+	return nil
+}
+
+// changedPlans returns the name of every new or changed plan, once their settings are checked.
+// Nothing is built
+func (r *MultiRateLimiter) changedPlans(previous *planTable, plans map[string][]RateLimiterSettings) ([]string, error) {
+	var changed []string
+	for name, windows := range plans {
+		if _, ok := previous.plans[name]; ok && sameWindows(previous.windows[name], windows) {
+			continue
+		}
+		if err := checkWindows(r.factory, r.nodes, windows); err != nil {
+			return nil, err
+		}
+		changed = append(changed, name)
+	}
+	return changed, nil
+}
+
+// checkPlans reports whether UpdatePlans would fail to apply the settings of the plans
+func (r *MultiRateLimiter) checkPlans(plans map[string][]RateLimiterSettings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.changedPlans(r.planTable(), plans)
+	return err
+}
+
+func (r *MultiRateLimiter) planTable() *planTable {
+	table, _ := r.plans.Load().(*planTable)
+	if table == nil {
+		return &planTable{}
+	}
+	return table
+}
+
+func sameWindows(a, b []RateLimiterSettings) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWindows reports whether the rate limiters built by the factory accept the settings of
+// the windows, without building them (nor their stores)
+func checkWindows(factory RateLimiterFactory, nodes int, windows []RateLimiterSettings) error {
+	if len(windows) == 0 {
+		return errors.New("at least one rate limit window is required")
+	}
+	for _, w := range windows {
+		s := splitSettings(w, nodes, isClusterWide(factory), nodeSplit(factory))
+		if _, err := newRate(s.maxRequests, s.period); err != nil {
+			return err
+		}
+		if s.burstSize < 0 {
+			return fmt.Errorf("invalid burst size: %d", s.burstSize)
+		}
+	}
+	return nil
+}
+
+// clusterWindows returns the windows of a rate limiter, if it has n windows that can be
+// updated in place. Otherwise, it returns nil and the rate limiter must be rebuilt
+func clusterWindows(rl UpdatableClusterRateLimiter, n int) []*ClusterAwareRateLimiter {
+	var current []UpdatableClusterRateLimiter
+	switch r := rl.(type) {
+	case *ClusterAwareRateLimiter:
+		current = []UpdatableClusterRateLimiter{r}
+	case *MultiWindowRateLimiter:
+		current = r.windows
+	}
+	if len(current) != n {
+		return nil
+	}
+	windows := make([]*ClusterAwareRateLimiter, n)
+	for i, w := range current {
+		window, ok := w.(*ClusterAwareRateLimiter)
+		if !ok {
+			return nil
+		}
+		windows[i] = window
+	}
+	return windows
+}
+
+// ReloadPlans applies the plans and the tenants (read again from the TenantsFile) of the config
+// to a rate limiter built by BuildRateLimiter. The other tenants are not rebuilt. The plans of
+// every level (sub limits, local fallback) are checked before updating any, so a failed reload
+// changes nothing. The TenantsFile is not watched: call ReloadPlans when it changes
+func ReloadPlans(rateLimiter UpdatableClusterRateLimiter, c RateLimitConfig) error {
+	tenants, err := LoadTenants(c)
+	if err != nil {
+		return err
+	}
+	levels, err := planLevels(rateLimiter, c)
+	if err != nil {
+		return err
+	}
+	for _, l := range levels {
+		if err := l.rateLimiter.checkPlans(l.plans); err != nil {
+			return err
+		}
+	}
+	for _, l := range levels {
+		if err := l.rateLimiter.UpdatePlans(l.plans, tenants); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planLevel is a rate limiter with plans and the plans of its config
+type planLevel struct {
+	rateLimiter *MultiRateLimiter
+	plans       map[string][]RateLimiterSettings
+}
+
+func planLevels(rateLimiter UpdatableClusterRateLimiter, c RateLimitConfig) ([]planLevel, error) {
+	switch rl := rateLimiter.(type) {
+	case *MultiRateLimiter:
+		return []planLevel{{rateLimiter: rl, plans: getRLPlans(c)}}, nil
+	case *FallbackRateLimiter:
+		primary, err := planLevels(rl.primary, c)
+		if err != nil {
+			return nil, err
+		}
+		fallback, err := planLevels(rl.fallback, c)
+		if err != nil {
+			return nil, err
+		}
+		return append(primary, fallback...), nil
+	case *HierarchicalRateLimiter:
+		levels, err := planLevels(rl.parent, c)
+		if err != nil {
+			return nil, err
+		}
+		// the absolute sub limits do not depend on the plans
+		if c.SubLimit.Fraction <= 0 {
+			return levels, nil
+		}
+		child, err := planLevels(rl.child, subLimitConfig(c))
+		if err != nil {
+			return nil, err
+		}
+		return append(levels, child...), nil
+	}
+	return nil, errors.New("the rate limiter has no plans")
+}
+
+func getRLPlans(c RateLimitConfig) map[string][]RateLimiterSettings {
+	plans := make(map[string][]RateLimiterSettings, len(c.Plans))
+	for name, s := range c.Plans {
+		plans[name] = getRLWindows(s)
+	}
+	return plans
+}
+
+// LoadTenants returns the tenant to plan mapping of the TenantsFile merged with the inline
+// one. Every plan must be defined in the config
+func LoadTenants(c RateLimitConfig) (map[string]string, error) {
+	tenants := map[string]string{}
+	if c.TenantsFile != "" {
+		f, err := os.Open(c.TenantsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if strings.EqualFold(filepath.Ext(c.TenantsFile), ".csv") {
+			tenants, err = readTenantsCSV(f)
+		} else {
+			err = json.NewDecoder(f).Decode(&tenants)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tenants file %s: %s", c.TenantsFile, err.Error())
+		}
+	}
+	for tenant, plan := range c.Tenants {
+		tenants[tenant] = plan
+	}
+	for tenant, plan := range tenants {
+		if _, ok := c.Plans[plan]; !ok {
+			return nil, fmt.Errorf("unknown plan '%s' of tenant '%s'", plan, tenant)
+		}
+	}
+	return tenants, nil
+}
+
+// readTenantsCSV reads tenant,plan records. Lines starting with # are comments and a
+// tenant,plan header is skipped
+func readTenantsCSV(r io.Reader) (map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	tenants := make(map[string]string, len(records))
+	for i, record := range records {
+		tenant, plan := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if i == 0 && tenant == "tenant" && plan == "plan" {
+			continue
+		}
+		tenants[tenant] = plan
+	}
+	return tenants, nil
+}
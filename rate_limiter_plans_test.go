@@ -0,0 +1,287 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/throttled/throttled"
+)
+
+func assertLimited(t *testing.T, rl UpdatableClusterRateLimiter, key string, expected ...bool) {
+	for i, e := range expected {
+		limited, _, err := rl.RateLimit(key, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if limited != e {
+			t.Errorf("Unexpected limited value for %s request %d (expected: %t, got: %t)", key, i, e, limited)
+		}
+	}
+}
+
+func TestMultiRateLimiterPlans(t *testing.T) {
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	plans := map[string][]RateLimiterSettings{
+		"free": {{maxRequests: 1, period: time.Hour}},
+		"pro":  {{maxRequests: 2, period: time.Hour, burstSize: 1}},
+	}
+	tenants := map[string]string{"kufar.com": "free", "corotos.com": "free", "partner.com": "pro", "vip.com": "free"}
+	custom := map[string][]RateLimiterSettings{"vip.com": {{maxRequests: 3, period: time.Hour, burstSize: 2}}}
+	rl, err := NewMultiRateLimiterWithPlans(factory, 1, []RateLimiterSettings{{maxRequests: 100, period: time.Minute, burstSize: 10}},
+		custom, plans, tenants)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// the tenants of a plan share its rate limiter, but not their buckets
+	if rl.rateLimiter("kufar.com") != rl.rateLimiter("corotos.com") {
+		t.Errorf("The tenants of the same plan must share the rate limiter")
+	}
+	assertLimited(t, rl, "kufar.com", false, true)
+	assertLimited(t, rl, "corotos.com", false, true)
+	assertLimited(t, rl, "partner.com", false, false, true)
+	// the exact custom key wins
+	assertLimited(t, rl, "vip.com", false, false, false, true)
+	assertLimited(t, rl, "other.com", false, false, false, false)
+
+	if _, err := NewMultiRateLimiterWithPlans(factory, 1, []RateLimiterSettings{{maxRequests: 100, period: time.Minute, burstSize: 10}},
+		nil, plans, map[string]string{"kufar.com": "enterprise"}); err == nil {
+		t.Errorf("An error is expected for an unknown plan")
+	}
+}
+
+func TestMultiRateLimiterUpdatePlans(t *testing.T) {
+	factory, _ := NewRateLimiterFactory(StoreConfig{})
+	plans := map[string][]RateLimiterSettings{
+		"free": {{maxRequests: 1, period: time.Hour}},
+		"pro":  {{maxRequests: 2, period: time.Hour, burstSize: 1}},
+		"gold": {{maxRequests: 2, period: time.Hour, burstSize: 1}},
+	}
+	tenants := map[string]string{"kufar.com": "free", "corotos.com": "free", "partner.com": "pro"}
+	rl, err := NewMultiRateLimiterWithPlans(factory, 3, []RateLimiterSettings{{maxRequests: 100, period: time.Minute, burstSize: 10}},
+		nil, plans, tenants)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := rl.UpdateNodeCount(1); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	assertLimited(t, rl, "kufar.com", false, true)
+	assertLimited(t, rl, "corotos.com", false, true)
+	free := rl.rateLimiter("kufar.com")
+	pro := rl.rateLimiter("partner.com")
+	gold := rl.planTable().plans["gold"]
+
+	// pro gets more requests, gold gets a second window, kufar.com moves to pro and enterprise is new
+	err = rl.UpdatePlans(map[string][]RateLimiterSettings{
+		"free":       {{maxRequests: 1, period: time.Hour}},
+		"pro":        {{maxRequests: 5, period: time.Hour, burstSize: 4}},
+		"gold":       {{maxRequests: 2, period: time.Hour, burstSize: 1}, {maxRequests: 100, period: 24 * time.Hour}},
+		"enterprise": {{maxRequests: 10, period: time.Hour, burstSize: 9}},
+	}, map[string]string{"kufar.com": "pro", "corotos.com": "free", "partner.com": "pro", "other.com": "enterprise"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if rl.rateLimiter("corotos.com") != free {
+		t.Errorf("The unchanged plan must not be rebuilt")
+	}
+	if rl.rateLimiter("partner.com") != pro || rl.rateLimiter("kufar.com") != pro {
+		t.Errorf("The changed plan must be updated in place")
+	}
+	if rl.planTable().plans["gold"] == gold {
+		t.Errorf("The plan with a new window must be rebuilt")
+	}
+	if s := pro.(*ClusterAwareRateLimiter).settings; s.maxRequests != 5 || s.burstSize != 4 {
+		t.Errorf("Unexpected pro settings: %+v", s)
+	}
+	if nodes := rl.planTable().plans["enterprise"].Nodes(); nodes != 1 {
+		t.Errorf("Unexpected node count of a new plan (expected: 1, got: %d)", nodes)
+	}
+	// corotos.com keeps its exhausted bucket and kufar.com gets the pro budget
+	assertLimited(t, rl, "corotos.com", true)
+	assertLimited(t, rl, "kufar.com", false, false, false, false, false, true)
+	assertLimited(t, rl, "other.com", false)
+
+	if err := rl.UpdatePlans(plans, map[string]string{"kufar.com": "platinum"}); err == nil {
+		t.Errorf("An error is expected for an unknown plan")
+	}
+	if rl.rateLimiter("other.com") != rl.planTable().plans["enterprise"] {
+		t.Errorf("A failed update must not change the plans")
+	}
+	// the valid changed plan is not updated when another one is invalid
+	err = rl.UpdatePlans(map[string][]RateLimiterSettings{
+		"pro":  {{maxRequests: 8, period: time.Hour}},
+		"free": {{maxRequests: 1, period: 48 * time.Hour}},
+	}, map[string]string{"partner.com": "pro"})
+	if err == nil {
+		t.Errorf("An error is expected for an invalid plan")
+	}
+	if s := pro.(*ClusterAwareRateLimiter).settings; s.maxRequests != 5 || s.burstSize != 4 {
+		t.Errorf("A failed update must not change the pro settings: %+v", s)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "tenants.json")
+	csvFile := filepath.Join(dir, "tenants.csv")
+	ioutil.WriteFile(jsonFile, []byte(`{"kufar.com": "pro", "corotos.com": "free"}`), 0600)
+	ioutil.WriteFile(csvFile, []byte("tenant,plan\n# partners\nkufar.com, pro\n\"acme, inc\",free\n"), 0600)
+	plans := map[string]RateLimitSettings{"free": {MaxRequests: 10}, "pro": {MaxRequests: 100}}
+
+	checks := []struct {
+		name     string
+		cfg      RateLimitConfig
+		expected map[string]string
+	}{
+		{
+			name:     "inline",
+			cfg:      RateLimitConfig{Plans: plans, Tenants: map[string]string{"kufar.com": "pro"}},
+			expected: map[string]string{"kufar.com": "pro"},
+		},
+		{
+			name:     "json file",
+			cfg:      RateLimitConfig{Plans: plans, TenantsFile: jsonFile, Tenants: map[string]string{"corotos.com": "pro"}},
+			expected: map[string]string{"kufar.com": "pro", "corotos.com": "pro"},
+		},
+		{
+			name:     "csv file",
+			cfg:      RateLimitConfig{Plans: plans, TenantsFile: csvFile},
+			expected: map[string]string{"kufar.com": "pro", "acme, inc": "free"},
+		},
+	}
+	for _, c := range checks {
+		tenants, err := LoadTenants(c.cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(tenants, c.expected) {
+			t.Errorf("%s: unexpected tenants (expected: %v, got: %v)", c.name, c.expected, tenants)
+		}
+	}
+
+	badCSV := filepath.Join(dir, "bad.csv")
+	ioutil.WriteFile(badCSV, []byte("kufar.com,pro,extra\n"), 0600)
+	for _, cfg := range []RateLimitConfig{
+		{Plans: plans, TenantsFile: filepath.Join(dir, "missing.json")},
+		{Plans: plans, TenantsFile: badCSV},
+		{Plans: map[string]RateLimitSettings{"free": {MaxRequests: 10}}, TenantsFile: jsonFile},
+	} {
+		if _, err := LoadTenants(cfg); err == nil {
+			t.Errorf("An error is expected for %+v", cfg)
+		}
+	}
+}
+
+// countingFactory counts the rate limiters built by its factory
+type countingFactory struct {
+	RateLimiterFactory
+	builds int
+}
+
+func (f *countingFactory) Build(maxRequests int, period time.Duration, burstSize int) (throttled.RateLimiter, error) {
+	f.builds++
+	return f.RateLimiterFactory.Build(maxRequests, period, burstSize)
+}
+
+func TestMultiRateLimiterUpdatePlansInPlace(t *testing.T) {
+	factory := &countingFactory{RateLimiterFactory: InMemoryGCRARateLimiterFactory{}}
+	plans := map[string][]RateLimiterSettings{
+		"free": {{maxRequests: 1, period: time.Hour}},
+		"pro":  {{maxRequests: 2, period: time.Second}, {maxRequests: 10, period: time.Hour}},
+	}
+	rl, err := NewMultiRateLimiterWithPlans(factory, 1, []RateLimiterSettings{{maxRequests: 100, period: time.Minute}},
+		nil, plans, map[string]string{"partner.com": "pro"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	pro := rl.planTable().plans["pro"].(*MultiWindowRateLimiter)
+
+	// the second window is invalid, so the first one must not be updated
+	factory.builds = 0
+	err = rl.UpdatePlans(map[string][]RateLimiterSettings{
+		"free": {{maxRequests: 1, period: time.Hour}},
+		"pro":  {{maxRequests: 5, period: time.Second}, {maxRequests: 1, period: 48 * time.Hour}},
+	}, map[string]string{"partner.com": "pro"})
+	if err == nil {
+		t.Errorf("An error is expected for an invalid window")
+	}
+	if s := pro.windows[0].(*ClusterAwareRateLimiter).settings; s.maxRequests != 2 {
+		t.Errorf("A failed update must not change the first window: %+v", s)
+	}
+	if factory.builds != 0 {
+		t.Errorf("Unexpected rate limiters built by a failed update (expected: 0, got: %d)", factory.builds)
+	}
+
+	// only the updated windows build a rate limiter, no discarded plan is built
+	err = rl.UpdatePlans(map[string][]RateLimiterSettings{
+		"free": {{maxRequests: 1, period: time.Hour}},
+		"pro":  {{maxRequests: 5, period: time.Second}, {maxRequests: 20, period: time.Hour}},
+	}, map[string]string{"partner.com": "pro"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if rl.planTable().plans["pro"] != pro {
+		t.Errorf("The changed plan must be updated in place")
+	}
+	if factory.builds != 2 {
+		t.Errorf("Unexpected rate limiters built (expected: 2, got: %d)", factory.builds)
+	}
+}
+
+func TestReloadPlans(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tenants.csv")
+	ioutil.WriteFile(file, []byte("kufar.com,free\n"), 0600)
+	cfg := RateLimitConfig{
+		Default:     RateLimitSettings{MaxRequests: 100, BurstSize: 10},
+		Plans:       map[string]RateLimitSettings{"free": {MaxRequests: 1, Period: time.Hour}, "pro": {MaxRequests: 3, Period: time.Hour, BurstSize: 2}},
+		TenantsFile: file,
+	}
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	rl := BuildRateLimiter(cfg, func() int { return 1 }, logger)
+	assertLimited(t, rl, "kufar.com", false, true)
+	assertLimited(t, rl, "corotos.com", false, false)
+
+	ioutil.WriteFile(file, []byte("kufar.com,pro\ncorotos.com,free\n"), 0600)
+	if err := ReloadPlans(rl, cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	assertLimited(t, rl, "kufar.com", false, false, false, true)
+	assertLimited(t, rl, "corotos.com", false, true)
+
+	if err := ReloadPlans(&MultiWindowRateLimiter{}, cfg); err == nil {
+		t.Errorf("An error is expected for a rate limiter without plans")
+	}
+}
+
+func TestReloadPlansFailure(t *testing.T) {
+	cfg := RateLimitConfig{
+		Default:  RateLimitSettings{MaxRequests: 100, BurstSize: 10},
+		Plans:    map[string]RateLimitSettings{"free": {MaxRequests: 1, Period: time.Hour}},
+		Tenants:  map[string]string{"kufar.com": "free"},
+		SubLimit: SubLimitConfig{Fraction: 0.25},
+	}
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	rl := BuildRateLimiter(cfg, func() int { return 1 }, logger).(*HierarchicalRateLimiter)
+
+	// 3 requests per 48h are valid, but the sub limit of 1 request per 48h is not
+	cfg.Plans = map[string]RateLimitSettings{"free": {MaxRequests: 3, Period: 48 * time.Hour}}
+	if err := ReloadPlans(rl, cfg); err == nil {
+		t.Fatalf("An error is expected for an invalid sub limit plan")
+	}
+	free := rl.parent.(*MultiRateLimiter).planTable().plans["free"].(*ClusterAwareRateLimiter)
+	if s := free.settings; s.maxRequests != 1 || s.period != time.Hour {
+		t.Errorf("A failed reload must not change the plans of the key: %+v", s)
+	}
+}
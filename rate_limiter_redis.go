@@ -0,0 +1,66 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/redigostore"
+)
+
+const defaultRedisMaxIdle = 10
+
+// RedisGCRARateLimiterFactory builds GCRA rate limiters sharing their state in Redis,
+// so the configured limits are enforced cluster wide and they are not divided by the
+// node count
+type RedisGCRARateLimiterFactory struct {
+	pool   *redis.Pool
+	prefix string
+	db     int
+}
+
+func NewRedisGCRARateLimiterFactory(cfg StoreConfig) *RedisGCRARateLimiterFactory {
+	maxIdle := defaultRedisMaxIdle
+	if cfg.MaxIdle != nil {
+		maxIdle = *cfg.MaxIdle
+	}
+	pool := &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Address, redis.DialPassword(cfg.Password))
+		},
+	}
+	return &RedisGCRARateLimiterFactory{pool: pool, prefix: cfg.KeyPrefix, db: cfg.DB}
+}
+
+// Build a GCRA rate limiter. Keys are prefixed with the factory prefix and the quota, so
+// the rate limiters with different settings (e.g. two windows with the same period, or a
+// plan and a custom key) do not share their state. The stored values depend on the quota,
+// so the buckets are reset when the settings change
+func (f *RedisGCRARateLimiterFactory) Build(maxRequests int, period time.Duration, burstSize int) (throttled.RateLimiter, error) {
+	prefix := fmt.Sprintf("%s%d/%s/%d:", f.prefix, maxRequests, period, burstSize)
+	store, err := redigostore.New(f.pool, prefix, f.db)
+	if err != nil {
+		return nil, err
+	}
+
+	rate, err := newRate(maxRequests, period)
+	if err != nil {
+		return nil, err
+	}
+	quota := throttled.RateQuota{MaxRate: rate, MaxBurst: burstSize}
+	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
+	if err != nil {
+		return nil, err
+	}
+	return rateLimiter, nil
+}
+
+func (f *RedisGCRARateLimiterFactory) ClusterWide() bool { return true }
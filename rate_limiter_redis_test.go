@@ -0,0 +1,148 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/devopsfaith/krakend/config"
+)
+
+func TestRedisRateLimiterIsClusterWide(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start miniredis: %s", err.Error())
+	}
+	defer mr.Close()
+
+	factory, err := NewRateLimiterFactory(StoreConfig{Type: RedisStore, Address: mr.Addr(), KeyPrefix: "test:"})
+	if err != nil {
+		t.Fatalf("Unable to build the redis factory: %s", err.Error())
+	}
+	if _, ok := factory.(*RedisGCRARateLimiterFactory); !ok {
+		t.Fatalf("Unexpected factory type %T", factory)
+	}
+
+	// two nodes sharing the same store: 3 requests (burst + 1) allowed cluster wide
+	settings := RateLimiterSettings{maxRequests: 1, period: time.Hour, burstSize: 2}
+	node1, err := NewClusterAwareRateLimiter(factory, 2, settings)
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+	node2, err := NewClusterAwareRateLimiter(factory, 2, settings)
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+
+	checks := []struct {
+		rl       UpdatableClusterRateLimiter
+		expected bool
+	}{
+		{rl: node1, expected: false},
+		{rl: node2, expected: false},
+		{rl: node1, expected: false},
+		{rl: node2, expected: true},
+		{rl: node1, expected: true},
+	}
+	for i, c := range checks {
+		limited, _, err := c.rl.RateLimit("key", 1)
+		if err != nil {
+			t.Errorf("Request %d failed %s", i, err.Error())
+		}
+		if limited != c.expected {
+			t.Errorf("Unexpected limited value for request %d (expected: %t, got %t)", i, c.expected, limited)
+		}
+	}
+
+	if !mr.Exists("test:1/1h0m0s/2:key") {
+		t.Errorf("Rate limit key not found in redis (keys: %v)", mr.Keys())
+	}
+
+	// updating the node count does not divide the shared limits
+	if err := node1.UpdateNodeCount(3); err != nil {
+		t.Errorf("UpdateNodeCount failed %s", err.Error())
+	}
+	if node1.Nodes() != 3 {
+		t.Errorf("Unexpected cluster nodes (got: %d, expected 3)", node1.Nodes())
+	}
+	if s := node1.(*ClusterAwareRateLimiter).settings; s != settings {
+		t.Errorf("Unexpected settings (expected: %+v, got: %+v)", settings, s)
+	}
+}
+
+func TestRedisRateLimiterStoreError(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start miniredis: %s", err.Error())
+	}
+	factory := NewRedisGCRARateLimiterFactory(StoreConfig{Type: RedisStore, Address: mr.Addr()})
+	rl, err := NewClusterAwareRateLimiter(factory, 1, RateLimiterSettings{maxRequests: 10, period: time.Minute})
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+	mr.Close()
+
+	if _, _, err := rl.RateLimit("key", 1); err == nil {
+		t.Errorf("An error is expected when redis is down")
+	}
+}
+
+func TestRedisRateLimiterQuotaPrefix(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start miniredis: %s", err.Error())
+	}
+	defer mr.Close()
+
+	// two windows with the same period must not share their state
+	factory := NewRedisGCRARateLimiterFactory(StoreConfig{Type: RedisStore, Address: mr.Addr()})
+	rl, err := NewMultiWindowRateLimiter(factory, 1, []RateLimiterSettings{
+		{maxRequests: 1, period: time.Hour, burstSize: 1},
+		{maxRequests: 10, period: time.Hour, burstSize: 2},
+	})
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+	for i, expected := range []bool{false, false, true} {
+		limited, _, err := rl.RateLimit("key", 1)
+		if err != nil {
+			t.Fatalf("Request %d failed %s", i, err.Error())
+		}
+		if limited != expected {
+			t.Errorf("Unexpected limited value for request %d (expected: %t, got %t)", i, expected, limited)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 2 {
+		t.Errorf("Unexpected keys in redis: %v", keys)
+	}
+}
+
+func TestRedisMaxIdle(t *testing.T) {
+	cfg, err := ParseConfig(config.ExtraConfig{Namespace: map[string]interface{}{
+		"default": map[string]interface{}{"max_requests": 10.0},
+		"store":   map[string]interface{}{"type": RedisStore, "address": "localhost:6379", "max_idle": 0.0},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	five := 5
+	checks := []struct {
+		maxIdle  *int
+		expected int
+	}{
+		{maxIdle: nil, expected: defaultRedisMaxIdle},
+		{maxIdle: &five, expected: 5},
+		{maxIdle: cfg.Store.MaxIdle, expected: 0},
+	}
+	for i, c := range checks {
+		factory := NewRedisGCRARateLimiterFactory(StoreConfig{Type: RedisStore, MaxIdle: c.maxIdle})
+		if factory.pool.MaxIdle != c.expected {
+			t.Errorf("Unexpected max idle connections for check %d (expected: %d, got: %d)", i, c.expected, factory.pool.MaxIdle)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/throttled/throttled"
+)
+
+// StatefulRateLimiterFactory is implemented by the factories able to build a rate
+// limiter reusing the state of a previous one, so updates do not reset the limits
+type StatefulRateLimiterFactory interface {
+	RateLimiterFactory
+	Rebuild(previous throttled.RateLimiter, maxRequests int, period time.Duration, burstSize int) (throttled.RateLimiter, error)
+}
+
+// GCRA rate limiter built by InMemoryGCRARateLimiterFactory. It keeps a reference
+// to its store, so it can be reused with another quota
+type memGCRARateLimiter struct {
+	throttled.RateLimiter
+	store            *memStore
+	emissionInterval time.Duration
+}
+
+// Rebuild a GCRA rate limiter with the new quota on top of the store of the previous
+// one. The stored theoretical arrival times are rescaled, so every key keeps the same
+// amount of pending requests
+func (f InMemoryGCRARateLimiterFactory) Rebuild(previous throttled.RateLimiter, maxRequests int, period time.Duration,
+	burstSize int) (throttled.RateLimiter, error) {
+	prev, ok := previous.(*memGCRARateLimiter)
+	if !ok {
+		return f.Build(maxRequests, period, burstSize)
+	}
+
+	rateLimiter, err := newMemGCRARateLimiter(prev.store, maxRequests, period, burstSize)
+	if err != nil {
+		return nil, err
+	}
+	prev.store.rescale(time.Now(), float64(rateLimiter.emissionInterval)/float64(prev.emissionInterval))
+	return rateLimiter, nil
+}
+
+func newMemGCRARateLimiter(store *memStore, maxRequests int, period time.Duration, burstSize int) (*memGCRARateLimiter, error) {
+	rate, err := newRate(maxRequests, period)
+	if err != nil {
+		return nil, err
+	}
+	quota := throttled.RateQuota{MaxRate: rate, MaxBurst: burstSize}
+	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
+	if err != nil {
+		return nil, err
+	}
+	return &memGCRARateLimiter{
+		RateLimiter:      rateLimiter,
+		store:            store,
+		emissionInterval: period / time.Duration(maxRequests),
+	}, nil
+}
+
+// In-memory throttled.GCRAStore (no keys limit). Unlike memstore.MemStore, its
+// values can be rescaled when the quota changes
+type memStore struct {
+	sync.Mutex
+	m map[string]int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{m: make(map[string]int64)}
+}
+
+func (s *memStore) GetWithTime(key string) (int64, time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.m[key]
+	if !ok {
+		return -1, time.Now(), nil
+	}
+	return v, time.Now(), nil
+}
+
+// SetIfNotExistsWithTTL ignores the ttl. Expired keys are removed by rescale
+func (s *memStore) SetIfNotExistsWithTTL(key string, value int64, _ time.Duration) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.m[key]; ok {
+		return false, nil
+	}
+	s.m[key] = value
+	return true, nil
+}
+
+// CompareAndSwapWithTTL ignores the ttl. Expired keys are removed by rescale
+func (s *memStore) CompareAndSwapWithTTL(key string, old, new int64, _ time.Duration) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.m[key]
+	if !ok || v != old {
+		return false, nil
+	}
+	s.m[key] = new
+	return true, nil
+}
+
+// rescale multiplies the time left until every theoretical arrival time by factor.
+// Keys already in the past don't hold any state, so they are removed
+func (s *memStore) rescale(now time.Time, factor float64) {
+	s.Lock()
+	defer s.Unlock()
+	n := now.UnixNano()
+	for k, tat := range s.m {
+		if tat <= n {
+			delete(s.m, k)
+			continue
+		}
+		s.m[k] = n + int64(float64(tat-n)*factor)
+	}
+}
@@ -6,10 +6,12 @@ package ratelimit
 
 import (
 	"fmt"
+	"reflect"
 
 	"github.com/devopsfaith/krakend/logging"
 
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,11 +31,13 @@ type rateLimitResponse struct {
 
 type mockRateLimiter struct {
 	requests map[rateLimitRequest]rateLimitResponse
+	calls    []int // quantity of every request
 }
 
 type buildParams struct {
-	reqsMinute int
-	burstSize  int
+	maxRequests int
+	period      time.Duration
+	burstSize   int
 }
 
 type rateLimiterMockFactory struct {
@@ -42,6 +46,7 @@ type rateLimiterMockFactory struct {
 
 func (r *mockRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
 	req := rateLimitRequest{key: key, quantity: quantity}
+	r.calls = append(r.calls, quantity)
 	response, ok := r.requests[req]
 	if !ok {
 		return true, throttled.RateLimitResult{}, fmt.Errorf("Unexpected request key: %s", key)
@@ -63,11 +68,11 @@ func (f *rateLimiterMockFactory) addMock(request buildParams, mock throttled.Rat
 	f.mocks[request] = mock
 }
 
-func (f *rateLimiterMockFactory) Build(reqsMinute int, burstSize int) (throttled.RateLimiter, error) {
-	req := buildParams{reqsMinute: reqsMinute, burstSize: burstSize}
+func (f *rateLimiterMockFactory) Build(maxRequests int, period time.Duration, burstSize int) (throttled.RateLimiter, error) {
+	req := buildParams{maxRequests: maxRequests, period: period, burstSize: burstSize}
 	mock, ok := f.mocks[req]
 	if !ok {
-		return nil, fmt.Errorf("Unexpected build params reqsMinute: %d, burstSize %d", reqsMinute, burstSize)
+		return nil, fmt.Errorf("Unexpected build params maxRequests: %d, period: %s, burstSize %d", maxRequests, period, burstSize)
 	}
 	return mock, nil
 }
@@ -104,12 +109,15 @@ func TestBuildRateLimiterFromConfig(t *testing.T) {
 	// Verify DefaultRateLimiter was properly created
 	defaultRL := rl.defaultRL.(*ClusterAwareRateLimiter)
 	settings1 := defaultRL.settings
-	if settings1.reqsMinute != reqsMinute1 {
-		t.Errorf("Unexpected RateLimit reqsMinute (got: %d, expected %d)", settings1.reqsMinute, reqsMinute1)
+	if settings1.maxRequests != reqsMinute1 {
+		t.Errorf("Unexpected RateLimit maxRequests (got: %d, expected %d)", settings1.maxRequests, reqsMinute1)
 	}
 	if settings1.burstSize != burstSize1 {
 		t.Errorf("Unexpected RateLimit burstSize (got: %d, expected %d)", settings1.burstSize, burstSize1)
 	}
+	if settings1.period != time.Minute {
+		t.Errorf("Unexpected RateLimit period (got: %s, expected %s)", settings1.period, time.Minute)
+	}
 	if defaultRL.Nodes() != nodes {
 		t.Errorf("Unexpected RateLimit burstSize (got: %d, expected %d)", defaultRL.Nodes(), nodes)
 	}
@@ -124,8 +132,8 @@ func TestBuildRateLimiterFromConfig(t *testing.T) {
 	}
 	siteRL := customRL.(*ClusterAwareRateLimiter)
 	settings2 := siteRL.settings
-	if settings2.reqsMinute != reqsMinute2 {
-		t.Errorf("Unexpected RateLimit reqsMinute (got: %d, expected %d)", settings2.reqsMinute, reqsMinute2)
+	if settings2.maxRequests != reqsMinute2 {
+		t.Errorf("Unexpected RateLimit maxRequests (got: %d, expected %d)", settings2.maxRequests, reqsMinute2)
 	}
 	if settings2.burstSize != burstSize2 {
 		t.Errorf("Unexpected RateLimit burstSize (got: %d, expected %d)", settings2.burstSize, burstSize2)
@@ -149,13 +157,13 @@ func TestUpdateNodeCount(t *testing.T) {
 
 	// mock rate limit factory (we expect 2 calls to Build method)
 	factory := &rateLimiterMockFactory{}
-	rateLimtierSettings1 := buildParams{reqsMinute: nodeReqsMinute1, burstSize: nodeBurstSize1}
-	rateLimtierSettings2 := buildParams{reqsMinute: nodeReqsMinute2, burstSize: nodeBurstSize2}
+	rateLimtierSettings1 := buildParams{maxRequests: nodeReqsMinute1, period: time.Minute, burstSize: nodeBurstSize1}
+	rateLimtierSettings2 := buildParams{maxRequests: nodeReqsMinute2, period: time.Minute, burstSize: nodeBurstSize2}
 	factory.addMock(rateLimtierSettings1, &mockRateLimiter{})
 	factory.addMock(rateLimtierSettings2, &mockRateLimiter{})
 
 	// Build ClusterAwareRateLimiter (first call to RateLimitFactory.Build(...))
-	clusterSettings := RateLimiterSettings{reqsMinute: reqsMinute, burstSize: burstSize}
+	clusterSettings := RateLimiterSettings{maxRequests: reqsMinute, period: time.Minute, burstSize: burstSize}
 	updatableRL, err := NewClusterAwareRateLimiter(factory, nodes, clusterSettings)
 	if err != nil {
 		t.Errorf("Error building ClusterAwareRateLimiter: %s", err.Error())
@@ -173,6 +181,101 @@ func TestUpdateNodeCount(t *testing.T) {
 	}
 }
 
+func TestUpdateKeepsRateLimiterState(t *testing.T) {
+	// 2 nodes: 1 request per hour and burst 2 (3 requests) per node
+	clusterSettings := RateLimiterSettings{maxRequests: 2, period: time.Hour, burstSize: 4}
+	rl, err := NewClusterAwareRateLimiter(InMemoryGCRARateLimiterFactory{}, 2, clusterSettings)
+	if err != nil {
+		t.Fatalf("Error building ClusterAwareRateLimiter: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if limited, _, _ := rl.RateLimit("key", 1); limited {
+			t.Errorf("Request %d should not be limited", i)
+		}
+	}
+	if limited, _, _ := rl.RateLimit("key", 1); !limited {
+		t.Errorf("Request should be limited once the burst is exhausted")
+	}
+
+	// 1 node: 2 requests per hour and burst 4 (5 requests), but the 3 requests
+	// already done are kept instead of getting a fresh burst
+	if err := rl.UpdateNodeCount(1); err != nil {
+		t.Fatalf("UpdateNodeCount failed: %s", err.Error())
+	}
+	for i, expected := range []bool{false, false, true} {
+		limited, result, err := rl.RateLimit("key", 1)
+		if err != nil {
+			t.Errorf("Request %d failed: %s", i, err.Error())
+		}
+		if limited != expected {
+			t.Errorf("Unexpected limited value for request %d after the update (expected: %t, got %t)", i, expected, limited)
+		}
+		if result.Limit != 5 {
+			t.Errorf("Unexpected limit after the update (expected: 5, got: %d)", result.Limit)
+		}
+	}
+
+	// 2 nodes up again: other keys are not affected
+	if err := rl.UpdateNodeCount(2); err != nil {
+		t.Fatalf("UpdateNodeCount failed: %s", err.Error())
+	}
+	if limited, _, _ := rl.RateLimit("other", 1); limited {
+		t.Errorf("Request for a new key should not be limited")
+	}
+}
+
+func TestExactSplitRateLimiter(t *testing.T) {
+	index := 0
+	factory := &rateLimiterMockFactory{}
+	factory.addMock(buildParams{maxRequests: 3, period: time.Minute, burstSize: 2}, &mockRateLimiter{})
+	factory.addMock(buildParams{maxRequests: 2, period: time.Minute, burstSize: 1}, &mockRateLimiter{})
+	factory.addMock(buildParams{maxRequests: 1, period: time.Minute, burstSize: 0}, &mockRateLimiter{})
+
+	// 10 requests and burst 5 on 4 nodes: 3, 3, 2, 2 requests and 2, 1, 1, 1 burst
+	clusterSettings := RateLimiterSettings{maxRequests: 10, period: time.Minute, burstSize: 5}
+	rl, err := NewClusterAwareRateLimiter(WithNodeSplit(factory, ExactNodeSplit(func(int) int { return index })), 4, clusterSettings)
+	if err != nil {
+		t.Fatalf("Error building ClusterAwareRateLimiter: %s", err.Error())
+	}
+
+	checks := []struct {
+		name     string
+		index    int
+		nodes    int
+		expected RateLimiterSettings
+	}{
+		{name: "same count, new index", index: 3, nodes: 4, expected: RateLimiterSettings{maxRequests: 2, period: time.Minute, burstSize: 1}},
+		{name: "unknown node", index: -1, nodes: 4, expected: RateLimiterSettings{maxRequests: 2, period: time.Minute, burstSize: 1}},
+		{name: "node without share", index: 11, nodes: 12, expected: RateLimiterSettings{maxRequests: 1, period: time.Minute, burstSize: 0}},
+	}
+	for _, c := range checks {
+		index = c.index
+		if err := rl.UpdateNodeCount(c.nodes); err != nil {
+			t.Errorf("%s: UpdateNodeCount failed: %s", c.name, err.Error())
+		}
+		if applied := rl.(*ClusterAwareRateLimiter).applied; applied != c.expected {
+			t.Errorf("%s: unexpected node settings (expected: %+v, got: %+v)", c.name, c.expected, applied)
+		}
+	}
+}
+
+func TestMemStoreRescale(t *testing.T) {
+	store := newMemStore()
+	now := time.Now()
+	store.SetIfNotExistsWithTTL("pending", now.Add(10*time.Minute).UnixNano(), 0)
+	store.SetIfNotExistsWithTTL("expired", now.Add(-time.Minute).UnixNano(), 0)
+
+	store.rescale(now, 0.5)
+
+	v, _, _ := store.GetWithTime("pending")
+	if expected := now.Add(5 * time.Minute).UnixNano(); v != expected {
+		t.Errorf("Unexpected rescaled value (expected: %d, got: %d)", expected, v)
+	}
+	if v, _, _ := store.GetWithTime("expired"); v != -1 {
+		t.Errorf("Expired keys should be removed (got: %d)", v)
+	}
+}
+
 func TestClusterRateLimit(t *testing.T) {
 	// mock RateLimit request
 	key := "myKey"
@@ -187,11 +290,11 @@ func TestClusterRateLimit(t *testing.T) {
 
 	// mock rate limit factory
 	factory := &rateLimiterMockFactory{}
-	nodeSettings := buildParams{reqsMinute: 20, burstSize: 4}
+	nodeSettings := buildParams{maxRequests: 20, period: time.Minute, burstSize: 4}
 	factory.addMock(nodeSettings, &mock)
 
 	// Build ClusterAwareRateLimit
-	clusterSettings := RateLimiterSettings{reqsMinute: 60, burstSize: 10}
+	clusterSettings := RateLimiterSettings{maxRequests: 60, period: time.Minute, burstSize: 10}
 	updatableRL, err := NewClusterAwareRateLimiter(factory, 3, clusterSettings)
 
 	// Call RateLimit() and check results
@@ -232,15 +335,15 @@ func TestMultiRateLimit(t *testing.T) {
 
 	// mock rate limit factory
 	factory := &rateLimiterMockFactory{}
-	siteNodeSettings := buildParams{reqsMinute: 20, burstSize: 4}
-	defaultNodeSettings := buildParams{reqsMinute: 200, burstSize: 34}
+	siteNodeSettings := buildParams{maxRequests: 20, period: time.Minute, burstSize: 4}
+	defaultNodeSettings := buildParams{maxRequests: 200, period: time.Minute, burstSize: 34}
 	factory.addMock(siteNodeSettings, &siteMock)
 	factory.addMock(defaultNodeSettings, &defaultMock)
 
 	// Init/build MultiRateLimiter
-	siteSettings := RateLimiterSettings{reqsMinute: 60, burstSize: 10}
+	siteSettings := RateLimiterSettings{maxRequests: 60, period: time.Minute, burstSize: 10}
 	customSettings := map[string]RateLimiterSettings{siteKey: siteSettings}
-	defaultSettings := RateLimiterSettings{reqsMinute: 600, burstSize: 100}
+	defaultSettings := RateLimiterSettings{maxRequests: 600, period: time.Minute, burstSize: 100}
 	multiRL, err := NewMultiRateLimiter(factory, 3, defaultSettings, customSettings)
 	if err != nil {
 		t.Errorf("TestRateLimit: build failed %s", err.Error())
@@ -271,6 +374,270 @@ func TestMultiRateLimit(t *testing.T) {
 	}
 }
 
+func TestMultiWindowRateLimit(t *testing.T) {
+	key := "partner"
+	peek := rateLimitRequest{key: key, quantity: 0}
+	request := rateLimitRequest{key: key, quantity: 1}
+
+	// per second window, always allows the request
+	secondResult := getFakeRateLimitResult(21, 19, 1, -1)
+	secondMock := mockRateLimiter{}
+	secondMock.mockRequest(peek, rateLimitResponse{limited: false, result: getFakeRateLimitResult(21, 20, 1, -1)})
+	secondMock.mockRequest(request, rateLimitResponse{limited: false, result: secondResult})
+
+	// per day window, allows the request for "partner" but not for "exhausted"
+	dayResult := getFakeRateLimitResult(101, 3, 3600, -1)
+	dayMock := mockRateLimiter{}
+	dayMock.mockRequest(peek, rateLimitResponse{limited: false, result: getFakeRateLimitResult(101, 4, 3600, -1)})
+	dayMock.mockRequest(request, rateLimitResponse{limited: false, result: dayResult})
+	exhaustedResult := getFakeRateLimitResult(101, 0, 3600, 60)
+	dayMock.mockRequest(rateLimitRequest{key: "exhausted", quantity: 0}, rateLimitResponse{limited: false, result: getFakeRateLimitResult(101, 0, 3600, -1)})
+	dayMock.mockRequest(rateLimitRequest{key: "exhausted", quantity: 1}, rateLimitResponse{limited: true, result: exhaustedResult})
+	secondMock.mockRequest(rateLimitRequest{key: "exhausted", quantity: 0}, rateLimitResponse{limited: false, result: getFakeRateLimitResult(21, 20, 1, -1)})
+
+	// mock rate limit factory
+	factory := &rateLimiterMockFactory{}
+	factory.addMock(buildParams{maxRequests: 10, period: time.Second, burstSize: 10}, &secondMock)
+	factory.addMock(buildParams{maxRequests: 50000, period: 24 * time.Hour, burstSize: 50}, &dayMock)
+
+	windows := []RateLimiterSettings{
+		{maxRequests: 20, period: time.Second, burstSize: 20},
+		{maxRequests: 100000, period: 24 * time.Hour, burstSize: 100},
+	}
+	rl, err := NewWindowsRateLimiter(factory, 2, windows)
+	if err != nil {
+		t.Fatalf("TestMultiWindowRateLimit: build failed %s", err.Error())
+	}
+	if _, ok := rl.(*MultiWindowRateLimiter); !ok {
+		t.Fatalf("Unexpected rate limiter type %T", rl)
+	}
+
+	// allowed by both windows: the per day window is the most restrictive one
+	limited, result, err := rl.RateLimit(key, 1)
+	if err != nil {
+		t.Errorf("TestMultiWindowRateLimit: request failed %s", err.Error())
+	}
+	if limited {
+		t.Errorf("TestMultiWindowRateLimit: request should not be limited")
+	}
+	if result != dayResult {
+		t.Errorf("TestMultiWindowRateLimit: unexpected response (expected: %+v, got %+v)", dayResult, result)
+	}
+
+	// denied by the per day window: the per second window is only peeked (any
+	// other request to its mock would fail)
+	limited, result, err = rl.RateLimit("exhausted", 1)
+	if err != nil {
+		t.Errorf("TestMultiWindowRateLimit: request failed %s", err.Error())
+	}
+	if !limited {
+		t.Errorf("TestMultiWindowRateLimit: request should be limited")
+	}
+	if result != exhaustedResult {
+		t.Errorf("TestMultiWindowRateLimit: unexpected response (expected: %+v, got %+v)", exhaustedResult, result)
+	}
+}
+
+func TestMultiWindowRateLimitConsumesOnlyWhenAllowed(t *testing.T) {
+	windows := []RateLimiterSettings{
+		{maxRequests: 1, period: time.Hour, burstSize: 4},
+		{maxRequests: 1, period: 24 * time.Hour, burstSize: 1},
+	}
+	rl, err := NewWindowsRateLimiter(InMemoryGCRARateLimiterFactory{}, 1, windows)
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+
+	// the per day window allows 2 requests (burst + 1)
+	for i, expected := range []bool{false, false, true, true} {
+		limited, _, err := rl.RateLimit("key", 1)
+		if err != nil {
+			t.Errorf("Request %d failed %s", i, err.Error())
+		}
+		if limited != expected {
+			t.Errorf("Unexpected limited value for request %d (expected: %t, got %t)", i, expected, limited)
+		}
+	}
+
+	// denied requests must not consume the per hour window
+	_, result, _ := rl.(*MultiWindowRateLimiter).windows[0].RateLimit("key", 0)
+	if result.Remaining != 3 {
+		t.Errorf("Unexpected per hour remaining requests (expected: 3, got %d)", result.Remaining)
+	}
+}
+
+func TestMultiWindowRateLimitRefilledWindow(t *testing.T) {
+	key := "partner"
+	peek := rateLimitRequest{key: key, quantity: 0}
+	request := rateLimitRequest{key: key, quantity: 1}
+	refund := rateLimitRequest{key: key, quantity: -1}
+
+	// the per second window is empty when peeked, but refilled when asked for its RetryAfter
+	secondMock := mockRateLimiter{}
+	secondMock.mockRequest(peek, rateLimitResponse{limited: false, result: getFakeRateLimitResult(2, 0, 1, -1)})
+	secondMock.mockRequest(request, rateLimitResponse{limited: false, result: getFakeRateLimitResult(2, 0, 1, -1)})
+	secondMock.mockRequest(refund, rateLimitResponse{limited: false, result: getFakeRateLimitResult(2, 1, 0, -1)})
+
+	// the per day window is exhausted
+	exhaustedResult := getFakeRateLimitResult(101, 0, 3600, 60)
+	dayMock := mockRateLimiter{}
+	dayMock.mockRequest(peek, rateLimitResponse{limited: false, result: getFakeRateLimitResult(101, 0, 3600, -1)})
+	dayMock.mockRequest(request, rateLimitResponse{limited: true, result: exhaustedResult})
+
+	factory := &rateLimiterMockFactory{}
+	factory.addMock(buildParams{maxRequests: 2, period: time.Second, burstSize: 1}, &secondMock)
+	factory.addMock(buildParams{maxRequests: 100, period: 24 * time.Hour, burstSize: 100}, &dayMock)
+	rl, err := NewWindowsRateLimiter(factory, 1, []RateLimiterSettings{
+		{maxRequests: 2, period: time.Second, burstSize: 1},
+		{maxRequests: 100, period: 24 * time.Hour, burstSize: 100},
+	})
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+
+	// the quantity consumed by the refilled window is given back
+	limited, result, err := rl.RateLimit(key, 1)
+	if err != nil {
+		t.Fatalf("Request failed %s", err.Error())
+	}
+	if !limited || result != exhaustedResult {
+		t.Errorf("Unexpected response (expected: true %+v, got %t %+v)", exhaustedResult, limited, result)
+	}
+	if expected := []int{0, 1, -1}; !reflect.DeepEqual(secondMock.calls, expected) {
+		t.Errorf("Unexpected per second requests (expected: %v, got %v)", expected, secondMock.calls)
+	}
+	if expected := []int{0, 1}; !reflect.DeepEqual(dayMock.calls, expected) {
+		t.Errorf("Unexpected per day requests (expected: %v, got %v)", expected, dayMock.calls)
+	}
+
+	// once the per day window allows the request, the refilled window is not counted twice
+	secondMock.calls, dayMock.calls = nil, nil
+	dayMock.mockRequest(peek, rateLimitResponse{limited: false, result: getFakeRateLimitResult(101, 5, 3600, -1)})
+	dayMock.mockRequest(request, rateLimitResponse{limited: false, result: getFakeRateLimitResult(101, 4, 3600, -1)})
+	limited, result, err = rl.RateLimit(key, 1)
+	if err != nil {
+		t.Fatalf("Request failed %s", err.Error())
+	}
+	if limited || result.Remaining != 0 {
+		t.Errorf("Unexpected response %t %+v", limited, result)
+	}
+	if expected := []int{0, 1}; !reflect.DeepEqual(secondMock.calls, expected) {
+		t.Errorf("Unexpected per second requests (expected: %v, got %v)", expected, secondMock.calls)
+	}
+	if expected := []int{0, 1}; !reflect.DeepEqual(dayMock.calls, expected) {
+		t.Errorf("Unexpected per day requests (expected: %v, got %v)", expected, dayMock.calls)
+	}
+}
+
+func TestMultiWindowRateLimitRefund(t *testing.T) {
+	rl, err := NewWindowsRateLimiter(InMemoryGCRARateLimiterFactory{}, 1, []RateLimiterSettings{
+		{maxRequests: 1, period: time.Hour, burstSize: 2},
+		{maxRequests: 1, period: 24 * time.Hour, burstSize: 2},
+	})
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+	windows := rl.(*MultiWindowRateLimiter).windows
+	windows[1].RateLimit("key", 2)
+
+	// a negative quantity refunds every window, without going over the limit
+	for _, quantity := range []int{1, -1, -1} {
+		if _, _, err := rl.RateLimit("key", quantity); err != nil {
+			t.Fatalf("Request failed %s", err.Error())
+		}
+	}
+	for i, expected := range []int{3, 2} {
+		if _, result, _ := windows[i].RateLimit("key", 0); result.Remaining != expected {
+			t.Errorf("Unexpected remaining requests of window %d (expected: %d, got %d)", i, expected, result.Remaining)
+		}
+	}
+}
+
+// Run with -race: the node count is updated while the rate limiters are in use
+func TestConcurrentUpdateNodeCount(t *testing.T) {
+	factory := InMemoryGCRARateLimiterFactory{}
+	defaultWindows := []RateLimiterSettings{{maxRequests: 1000, period: time.Minute, burstSize: 100}}
+	customWindows := map[string][]RateLimiterSettings{
+		"kufar.com": {
+			{maxRequests: 100, period: time.Second, burstSize: 10},
+			{maxRequests: 1000, period: time.Hour, burstSize: 100},
+		},
+	}
+	rl, err := NewMultiRateLimiterWithWindows(factory, 1, defaultWindows, customWindows)
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys := []string{"kufar.com", "avito.ru", fmt.Sprintf("key-%d", i)}
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, _, err := rl.RateLimit(keys[j%len(keys)], 1); err != nil {
+					t.Errorf("RateLimit failed %s", err.Error())
+					return
+				}
+				rl.Nodes()
+			}
+		}(i)
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := rl.UpdateNodeCount(i%5 + 1); err != nil {
+			t.Errorf("UpdateNodeCount failed %s", err.Error())
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if rl.Nodes() != 5 {
+		t.Errorf("Unexpected cluster nodes (got: %d, expected 5)", rl.Nodes())
+	}
+}
+
+func TestNewRate(t *testing.T) {
+	checks := []struct {
+		maxRequests int
+		period      time.Duration
+		expected    throttled.Rate
+		expectedErr bool
+	}{
+		{maxRequests: 10, period: time.Second, expected: throttled.PerSec(10)},
+		{maxRequests: 10, period: time.Minute, expected: throttled.PerMin(10)},
+		{maxRequests: 10, period: time.Hour, expected: throttled.PerHour(10)},
+		{maxRequests: 50000, period: 24 * time.Hour, expected: throttled.PerDay(50000)},
+		{maxRequests: 30, period: 30 * time.Second, expected: throttled.PerDay(86400)},
+		{maxRequests: 1, period: 12 * time.Hour, expected: throttled.PerDay(2)},
+		{maxRequests: 1, period: 48 * time.Hour, expectedErr: true},
+		{maxRequests: 0, period: time.Minute, expectedErr: true},
+		{maxRequests: 10, period: 0, expectedErr: true},
+	}
+
+	for _, c := range checks {
+		got, err := newRate(c.maxRequests, c.period)
+		if c.expectedErr {
+			if err == nil {
+				t.Errorf("An error is expected for %d requests per %s", c.maxRequests, c.period)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %d requests per %s: %s", c.maxRequests, c.period, err.Error())
+		}
+		if got != c.expected {
+			t.Errorf("Unexpected rate for %d requests per %s (expected: %+v, got: %+v)", c.maxRequests, c.period, c.expected, got)
+		}
+	}
+}
+
 func getFakeRateLimitResult(limit int, remaining int, reset int, retry int) throttled.RateLimitResult {
 	return throttled.RateLimitResult{
 		Limit:      limit,
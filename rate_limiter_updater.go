@@ -0,0 +1,116 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+// ErrUpdaterStopped is returned by Updater.ForceRefresh once the updater is stopped
+var ErrUpdaterStopped = errors.New("ratelimit: updater stopped")
+
+// UpdaterHooks are called by the Updater from its own goroutine. Nil hooks are ignored
+type UpdaterHooks struct {
+	// OnNodeCountChange is called after the rate limiter has been updated to the new node count
+	OnNodeCountChange func(previous, current int)
+	// OnError is called when the rate limiter can not be updated to the new node count
+	OnError func(nodes int, err error)
+}
+
+// Updater keeps the node count of a rate limiter up to date (see StartUpdater)
+type Updater struct {
+	rateLimiter UpdatableClusterRateLimiter
+	interval    time.Duration
+	nodeCounter NodeCounter
+	logger      logging.Logger
+	hooks       UpdaterHooks
+	cancel      context.CancelFunc
+	refresh     chan chan error
+	done        chan struct{}
+}
+
+// StartUpdater checks the nodeCounter every interval in a new goroutine and updates the
+// rate limiter when the node count changes. The updater runs until ctx is done or Stop is called
+func StartUpdater(ctx context.Context, rateLimiter UpdatableClusterRateLimiter, interval time.Duration,
+	nodeCounter NodeCounter, logger logging.Logger, hooks UpdaterHooks) *Updater {
+	ctx, cancel := context.WithCancel(ctx)
+	u := &Updater{
+		rateLimiter: rateLimiter,
+		interval:    interval,
+		nodeCounter: nodeCounter,
+		logger:      logger,
+		hooks:       hooks,
+		cancel:      cancel,
+		refresh:     make(chan chan error),
+		done:        make(chan struct{}),
+	}
+	go u.run(ctx)
+	return u
+}
+
+// Stop the updater and wait until its goroutine exits
+func (u *Updater) Stop() {
+	u.cancel()
+	<-u.done
+}
+
+// Done is closed when the updater is stopped
+func (u *Updater) Done() <-chan struct{} {
+	return u.done
+}
+
+// ForceRefresh checks the node count right now, without waiting for the next tick.
+// It returns the UpdateNodeCount error, if any
+func (u *Updater) ForceRefresh() error {
+	res := make(chan error, 1)
+	select {
+	case u.refresh <- res:
+		return <-res
+	case <-u.done:
+		return ErrUpdaterStopped
+	}
+}
+
+func (u *Updater) run(ctx context.Context) {
+	defer close(u.done)
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.update()
+		case res := <-u.refresh:
+			res <- u.update()
+		}
+	}
+}
+
+func (u *Updater) update() error {
+	nodeCount := u.nodeCounter()
+	previous := u.rateLimiter.Nodes()
+	// the rate limiter is updated even if the count is the same, because the index of the
+	// node (see ExactNodeSplit) may have changed. It only rebuilds on changes of its settings
+	if nodeCount != previous {
+		u.logger.Info("Updating RateLimit node count", nodeCount)
+	}
+	if err := u.rateLimiter.UpdateNodeCount(nodeCount); err != nil {
+		u.logger.Error("Unable to update RateLimit node count to", nodeCount, ":", err.Error())
+		if u.hooks.OnError != nil {
+			u.hooks.OnError(nodeCount, err)
+		}
+		return err
+	}
+	if nodeCount != previous && u.hooks.OnNodeCountChange != nil {
+		u.hooks.OnNodeCountChange(previous, nodeCount)
+	}
+	return nil
+}
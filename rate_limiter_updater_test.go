@@ -0,0 +1,139 @@
+//
+// Copyright 2011 - 2018 Schibsted Products & Technology AS.
+// Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+//
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestUpdaterForceRefresh(t *testing.T) {
+	logger, _ := logging.NewLogger("ERROR", os.Stdout, "[KRAKEND]")
+	rl, err := NewClusterAwareRateLimiter(InMemoryGCRARateLimiterFactory{}, 1, RateLimiterSettings{maxRequests: 10, period: time.Minute})
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+
+	var nodes int32 = 1
+	type change struct{ previous, current int }
+	changes := make(chan change, 10)
+	hooks := UpdaterHooks{
+		OnNodeCountChange: func(previous, current int) { changes <- change{previous, current} },
+	}
+	updater := StartUpdater(context.Background(), rl, time.Hour, func() int { return int(atomic.LoadInt32(&nodes)) }, logger, hooks)
+	defer updater.Stop()
+
+	if err := updater.ForceRefresh(); err != nil {
+		t.Errorf("ForceRefresh failed %s", err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("Unexpected node count change without changes in the cluster")
+	}
+
+	atomic.StoreInt32(&nodes, 3)
+	if err := updater.ForceRefresh(); err != nil {
+		t.Errorf("ForceRefresh failed %s", err.Error())
+	}
+	if rl.Nodes() != 3 {
+		t.Errorf("Unexpected cluster nodes (got: %d, expected 3)", rl.Nodes())
+	}
+	select {
+	case c := <-changes:
+		if c.previous != 1 || c.current != 3 {
+			t.Errorf("Unexpected node count change (expected: {1 3}, got: %v)", c)
+		}
+	default:
+		t.Errorf("OnNodeCountChange was not called")
+	}
+}
+
+func TestUpdaterError(t *testing.T) {
+	logger, _ := logging.NewLogger("CRITICAL", os.Stdout, "[KRAKEND]")
+	rl := &failingClusterRateLimiter{nodes: 1, err: errors.New("update failed")}
+
+	var errNodes int
+	hooks := UpdaterHooks{
+		OnNodeCountChange: func(_, _ int) { t.Errorf("OnNodeCountChange called after an error") },
+		OnError:           func(nodes int, _ error) { errNodes = nodes },
+	}
+	updater := StartUpdater(context.Background(), rl, time.Hour, func() int { return 2 }, logger, hooks)
+	defer updater.Stop()
+
+	if err := updater.ForceRefresh(); err != rl.err {
+		t.Errorf("Unexpected error (expected: %v, got: %v)", rl.err, err)
+	}
+	if errNodes != 2 {
+		t.Errorf("Unexpected OnError node count (expected: 2, got: %d)", errNodes)
+	}
+}
+
+func TestUpdaterTicks(t *testing.T) {
+	logger, _ := logging.NewLogger("ERROR", os.Stdout, "[KRAKEND]")
+	rl, err := NewClusterAwareRateLimiter(InMemoryGCRARateLimiterFactory{}, 1, RateLimiterSettings{maxRequests: 10, period: time.Minute})
+	if err != nil {
+		t.Fatalf("Build failed %s", err.Error())
+	}
+
+	changed := make(chan struct{}, 1)
+	hooks := UpdaterHooks{
+		OnNodeCountChange: func(_, _ int) { changed <- struct{}{} },
+	}
+	updater := StartUpdater(context.Background(), rl, time.Millisecond, func() int { return 2 }, logger, hooks)
+	defer updater.Stop()
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatalf("The node count was not updated")
+	}
+	if rl.Nodes() != 2 {
+		t.Errorf("Unexpected cluster nodes (got: %d, expected 2)", rl.Nodes())
+	}
+}
+
+func TestUpdaterStop(t *testing.T) {
+	logger, _ := logging.NewLogger("ERROR", os.Stdout, "[KRAKEND]")
+	rl := &failingClusterRateLimiter{nodes: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updater := StartUpdater(ctx, rl, time.Hour, DefaultNodeCounter(), logger, UpdaterHooks{})
+	cancel()
+	select {
+	case <-updater.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("The updater was not stopped by the context")
+	}
+	if err := updater.ForceRefresh(); err != ErrUpdaterStopped {
+		t.Errorf("Unexpected error (expected: %v, got: %v)", ErrUpdaterStopped, err)
+	}
+
+	updater = StartUpdater(context.Background(), rl, time.Hour, DefaultNodeCounter(), logger, UpdaterHooks{})
+	updater.Stop()
+	if err := updater.ForceRefresh(); err != ErrUpdaterStopped {
+		t.Errorf("Unexpected error (expected: %v, got: %v)", ErrUpdaterStopped, err)
+	}
+}
+
+type failingClusterRateLimiter struct {
+	mockRateLimiter
+	nodes int
+	err   error
+}
+
+func (r *failingClusterRateLimiter) UpdateNodeCount(nodes int) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.nodes = nodes
+	return nil
+}
+
+func (r *failingClusterRateLimiter) Nodes() int { return r.nodes }